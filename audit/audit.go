@@ -0,0 +1,268 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+)
+
+// ResultOverride - recorded when change window, or freeze, is overridden,
+// other results are results of AWS calls
+const ResultOverride = "override"
+
+// Log file is rotated when it reaches maxSize bytes, maxBackups rotated files are kept
+const (
+	maxSize    = 10 * 1024 * 1024
+	maxBackups = 5
+)
+
+// ErrNotConfigured - returned when audit log file is not set
+var ErrNotConfigured = errors.New("Audit log file is not set")
+
+// Entry holds one audit record, written as one line of JSON
+type Entry struct {
+	Time          time.Time `json:"time" yaml:"time"`
+	User          string    `json:"user" yaml:"user"`
+	Host          string    `json:"host" yaml:"host"`
+	Identity      string    `json:"identity" yaml:"identity"`
+	OperationID   string    `json:"operation_id,omitempty" yaml:"operation_id,omitempty"`
+	Cluster       string    `json:"cluster" yaml:"cluster"`
+	Action        string    `json:"action" yaml:"action"`
+	Target        string    `json:"target,omitempty" yaml:"target,omitempty"`
+	Ec2InstanceID string    `json:"ec2_instance_id,omitempty" yaml:"ec2_instance_id,omitempty"`
+	Result        string    `json:"result,omitempty" yaml:"result,omitempty"`
+	Error         string    `json:"error,omitempty" yaml:"error,omitempty"`
+	Message       string    `json:"message,omitempty" yaml:"message,omitempty"`
+	Reason        string    `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// Query holds audit log filter, empty fields match all entries
+type Query struct {
+	// Cluster name or ARN
+	Cluster string
+	// Entries written at, or after, this time
+	Since time.Time
+	// Entries written before this time
+	Until time.Time
+}
+
+var (
+	mu   sync.Mutex
+	file string
+
+	identityOnce sync.Once
+	identity     string
+)
+
+// SetFile - set file audit records are appended to
+func SetFile(filename string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	file = filename
+}
+
+// File - get file audit records are appended to
+func File() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return file
+}
+
+// Identity - get AWS caller identity, it's looked up only once
+func Identity() string {
+	identityOnce.Do(func() {
+		arn, err := aws.GetCallerIdentity()
+
+		if err != nil {
+			identity = "unknown"
+			return
+		}
+
+		identity = arn
+	})
+
+	return identity
+}
+
+// Write - append entry to audit log. Time, user, host and AWS caller
+// identity are filled in if they are not set.
+func Write(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	if e.User == "" {
+		e.User = common.CurrentUser()
+	}
+
+	if e.Host == "" {
+		e.Host = common.Hostname()
+	}
+
+	if e.Identity == "" {
+		e.Identity = Identity()
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == "" {
+		return ErrNotConfigured
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	if err := rotate(); err != nil {
+		return fmt.Errorf("Couldn't rotate audit log: %v", err)
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Read - read entries matching query from audit log and rotated files,
+// oldest first
+func Read(q Query) ([]Entry, error) {
+	mu.Lock()
+	filename := file
+	mu.Unlock()
+
+	if filename == "" {
+		return nil, ErrNotConfigured
+	}
+
+	entries := []Entry{}
+
+	for i := maxBackups; i >= 0; i-- {
+		name := backupName(filename, i)
+
+		f, err := os.Open(name)
+
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return entries, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		line := 0
+
+		for scanner.Scan() {
+			line++
+
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+
+			var e Entry
+
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				f.Close()
+				return entries, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+
+			if q.Matches(e) {
+				entries = append(entries, e)
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if err != nil {
+			return entries, err
+		}
+	}
+
+	return entries, nil
+}
+
+// Matches - returns true if entry matches query
+func (q Query) Matches(e Entry) bool {
+	if q.Cluster != "" && e.Cluster != q.Cluster {
+		if name, err := aws.GetEcsClusterNameByArn(e.Cluster); err != nil || name != q.Cluster {
+			return false
+		}
+	}
+
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+// rotate - rename log file to <file>.1, <file>.1 to <file>.2 and so on, once
+// it reaches max size. The oldest file is removed.
+func rotate() error {
+	info, err := os.Stat(file)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < maxSize {
+		return nil
+	}
+
+	if err := os.Remove(backupName(file, maxBackups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for i := maxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(backupName(file, i), backupName(file, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupName - get name of n-th rotated file, 0 is current file
+func backupName(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d", filename, n)
+}
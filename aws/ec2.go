@@ -2,7 +2,6 @@ package aws
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,7 +27,7 @@ func TerminateEc2Instance(instance string) (string, error) {
 }
 
 // IsEc2InstanceTerminated - check if instance is terminated
-func IsEc2InstanceTerminated(instance string) bool {
+func IsEc2InstanceTerminated(instance string) (bool, error) {
 	svc := ec2.New(session.New())
 
 	input := &ec2.DescribeInstancesInput{
@@ -40,13 +39,46 @@ func IsEc2InstanceTerminated(instance string) bool {
 	result, err := svc.DescribeInstances(input)
 
 	if err != nil {
-		fmt.Printf("Failed to get instance info: %s\n", err)
-		os.Exit(1)
+		return false, fmt.Errorf("Failed to get instance info: %s", err)
+	}
+
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return false, fmt.Errorf("Instance %s not found", instance)
 	}
 
 	if *result.Reservations[0].Instances[0].State.Name == "terminated" {
-		return true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// GetEc2InstancesTags - get tags of EC2 instances, returns map of tags by instance ID
+func GetEc2InstancesTags(instances []string) (map[string]map[string]string, error) {
+	tags := map[string]map[string]string{}
+
+	if len(instances) == 0 {
+		return tags, nil
 	}
 
-	return false
+	svc := ec2.New(session.New())
+
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(instances),
+	}
+
+	err := svc.DescribeInstancesPages(input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				t := map[string]string{}
+				for _, tag := range i.Tags {
+					t[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+				tags[aws.StringValue(i.InstanceId)] = t
+			}
+		}
+		return true
+	})
+
+	return tags, err
 }
@@ -3,43 +3,81 @@ package aws
 import (
 	"errors"
 	"fmt"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
 )
 
 // EcsInstance holds information about ECS instance
 type EcsInstance struct {
-	ARN               string
-	Name              string
-	Ec2InstanceID     string
-	AMI               string
-	Status            string
-	AgentVersion      string
-	DockerVersion     string
-	PendingTasksCount int64
-	RunningTasksCount int64
-	RegisteredAt      string
-	RemainingCPU      int64
-	RemainingMemory   int64
+	ARN               string `json:"arn" yaml:"arn"`
+	Name              string `json:"name" yaml:"name"`
+	Ec2InstanceID     string `json:"ec2_instance_id" yaml:"ec2_instance_id"`
+	AMI               string `json:"ami" yaml:"ami"`
+	InstanceType      string `json:"instance_type" yaml:"instance_type"`
+	Status            string `json:"status" yaml:"status"`
+	AgentVersion      string `json:"agent_version" yaml:"agent_version"`
+	DockerVersion     string `json:"docker_version" yaml:"docker_version"`
+	PendingTasksCount int64  `json:"pending_tasks_count" yaml:"pending_tasks_count"`
+	RunningTasksCount int64  `json:"running_tasks_count" yaml:"running_tasks_count"`
+	RegisteredAt      string `json:"registered_at" yaml:"registered_at"`
+	RemainingCPU      int64  `json:"remaining_cpu" yaml:"remaining_cpu"`
+	RemainingMemory   int64  `json:"remaining_memory" yaml:"remaining_memory"`
+	RegisteredCPU     int64  `json:"registered_cpu" yaml:"registered_cpu"`
+	RegisteredMemory  int64  `json:"registered_memory" yaml:"registered_memory"`
 }
 
 // EcsCluster holds information about ECS cluster
 type EcsCluster struct {
-	ARN                      string
-	Name                     string
-	Status                   string
-	Region                   string
-	Account                  string
-	RegisteredInstancesCount int64
-	RunningTasksCount        int64
-	PendingTasksCount        int64
-	ActiveServicesCount      int64
+	ARN                      string `json:"arn" yaml:"arn"`
+	Name                     string `json:"name" yaml:"name"`
+	Status                   string `json:"status" yaml:"status"`
+	Region                   string `json:"region" yaml:"region"`
+	Account                  string `json:"account" yaml:"account"`
+	RegisteredInstancesCount int64  `json:"registered_instances_count" yaml:"registered_instances_count"`
+	RunningTasksCount        int64  `json:"running_tasks_count" yaml:"running_tasks_count"`
+	PendingTasksCount        int64  `json:"pending_tasks_count" yaml:"pending_tasks_count"`
+	ActiveServicesCount      int64  `json:"active_services_count" yaml:"active_services_count"`
+}
+
+// EcsTask holds information about ECS task
+type EcsTask struct {
+	ARN                 string     `json:"arn" yaml:"arn"`
+	ID                  string     `json:"id" yaml:"id"`
+	ContainerInstance   string     `json:"container_instance" yaml:"container_instance"`
+	Group               string     `json:"group" yaml:"group"`
+	ServiceName         string     `json:"service_name" yaml:"service_name"`
+	TaskDefinition      string     `json:"task_definition" yaml:"task_definition"`
+	LastStatus          string     `json:"last_status" yaml:"last_status"`
+	DesiredStatus       string     `json:"desired_status" yaml:"desired_status"`
+	Daemon              bool       `json:"daemon" yaml:"daemon"`
+	ProtectionEnabled   bool       `json:"protection_enabled" yaml:"protection_enabled"`
+	ProtectionExpiresAt *time.Time `json:"protection_expires_at,omitempty" yaml:"protection_expires_at,omitempty"`
+	// Scale-in protection couldn't be checked, task may be protected
+	ProtectionUnknown bool `json:"protection_unknown" yaml:"protection_unknown"`
+}
+
+// TaskProtectionError - returned with list of tasks when scale-in protection
+// of some tasks couldn't be checked, those tasks have ProtectionUnknown set
+type TaskProtectionError struct {
+	Err error
+}
+
+// Error - format task protection error
+func (e TaskProtectionError) Error() string {
+	return fmt.Sprintf("couldn't get scale-in protection of tasks: %v", e.Err)
+}
+
+// Unwrap - get underlying error
+func (e TaskProtectionError) Unwrap() error {
+	return e.Err
 }
 
 // GetEcsClusters - gets list of ECS clusters
@@ -88,6 +126,12 @@ func GetEcsClustersInfo(arns []string) ([]EcsCluster, error) {
 		clusterInfo.PendingTasksCount = *r.PendingTasksCount
 		clusterInfo.ActiveServicesCount = *r.ActiveServicesCount
 
+		// ARN format is arn:aws:ecs:<region>:<account>:cluster/<name>
+		if a := strings.Split(clusterInfo.ARN, ":"); len(a) > 5 {
+			clusterInfo.Region = a[3]
+			clusterInfo.Account = a[4]
+		}
+
 		clustersInfo = append(clustersInfo, clusterInfo)
 	}
 
@@ -160,6 +204,7 @@ func GetEcsClusterInstancesInfo(cluster string, instances []string) ([]EcsInstan
 		instanceInfo.PendingTasksCount = *ci.PendingTasksCount
 		instanceInfo.AgentVersion = *ci.VersionInfo.AgentVersion
 		instanceInfo.DockerVersion = strings.Replace(*ci.VersionInfo.DockerVersion, "DockerVersion: ", "", -1)
+		instanceInfo.RegisteredAt = aws.TimeValue(ci.RegisteredAt).Format(time.RFC3339)
 
 		for _, res := range ci.RemainingResources {
 			if *res.Name == "CPU" {
@@ -171,10 +216,22 @@ func GetEcsClusterInstancesInfo(cluster string, instances []string) ([]EcsInstan
 
 		}
 
+		for _, res := range ci.RegisteredResources {
+			if *res.Name == "CPU" {
+				instanceInfo.RegisteredCPU = *res.IntegerValue
+			}
+			if *res.Name == "MEMORY" {
+				instanceInfo.RegisteredMemory = *res.IntegerValue
+			}
+		}
+
 		for _, att := range ci.Attributes {
 			if *att.Name == "ecs.ami-id" {
 				instanceInfo.AMI = *att.Value
 			}
+			if *att.Name == "ecs.instance-type" {
+				instanceInfo.InstanceType = *att.Value
+			}
 		}
 
 		instancesInfo = append(instancesInfo, instanceInfo)
@@ -224,19 +281,25 @@ func GetEcsClusterNameByArn(arn string) (string, error) {
 // IsEcsClusterReady - check if cluster is ready,
 // all instances are in ACTIVE state and if mustHaveRunningTasks is specified,
 // all instances must have at least one running task
-func IsEcsClusterReady(arn string, mustHaveRunningTasks bool, numberOfZeroTasksInstances int) bool {
+func IsEcsClusterReady(arn string, mustHaveRunningTasks bool, numberOfZeroTasksInstances int) (bool, error) {
 	// Get cluster info
 	clusterInfo, err := GetEcsClustersInfo([]string{arn})
 	if err != nil {
-		fmt.Printf("Failed to get cluster info: %s\n", err)
-		os.Exit(1)
+		return false, fmt.Errorf("Failed to get cluster info: %s", err)
+	}
+
+	if len(clusterInfo) == 0 {
+		return false, fmt.Errorf("Cluster %s not found", arn)
 	}
 
 	// Get cluster instances list
 	instances, err := GetEcsClusterInstances(arn)
 	if err != nil {
-		fmt.Printf("Failed to get cluster instances: %s\n", err)
-		os.Exit(1)
+		return false, fmt.Errorf("Failed to get cluster instances: %s", err)
+	}
+
+	if len(instances) == 0 {
+		return false, nil
 	}
 
 	zeroTasksInstanceCnt := 0
@@ -244,25 +307,24 @@ func IsEcsClusterReady(arn string, mustHaveRunningTasks bool, numberOfZeroTasksI
 	// Get cluster instances info
 	instancesInfo, err := GetEcsClusterInstancesInfo(clusterInfo[0].Name, instances)
 	if err != nil {
-		fmt.Printf("\nFailed to get cluster instances info: %s\n", err)
-		os.Exit(1)
+		return false, fmt.Errorf("Failed to get cluster instances info: %s", err)
 	}
 
 	for _, inst := range instancesInfo {
 		if inst.Status != "ACTIVE" {
-			return false
+			return false, nil
 		}
 
-		if inst.RunningTasksCount < 1 {
+		if mustHaveRunningTasks && inst.RunningTasksCount < 1 {
 			zeroTasksInstanceCnt++
 		}
 	}
 
 	if zeroTasksInstanceCnt > numberOfZeroTasksInstances {
-		return false
+		return false, nil
 	}
 
-	return true
+	return true, nil
 }
 
 // StopEcsTask - stop task
@@ -307,31 +369,183 @@ func UpdateEcsContainerAgent(cluster string, instance string) (string, error) {
 	return *result.ContainerInstance.AgentUpdateStatus, nil
 }
 
-// GetEcsInstanceTasks - get tasks running on instance
+// GetEcsInstanceTasks - get tasks running on instance, or on all instances
+// in cluster if instance is empty
 func GetEcsInstanceTasks(cluster string, instance string) ([]string, error) {
 	tasks := []string{}
 	svc := ecs.New(session.New())
 	input := &ecs.ListTasksInput{
-		Cluster:           aws.String(cluster),
-		ContainerInstance: aws.String(instance),
-		DesiredStatus:     aws.String("RUNNING"),
+		Cluster:       aws.String(cluster),
+		DesiredStatus: aws.String("RUNNING"),
+	}
+
+	if instance != "" {
+		input.ContainerInstance = aws.String(instance)
 	}
 
-	result, err := svc.ListTasks(input)
+	re := regexp.MustCompile(`^arn:aws:ecs:.*:.*:task/(.*)$`)
+
+	err := svc.ListTasksPages(input, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		for _, taskArn := range page.TaskArns {
+			m := re.FindStringSubmatch(*taskArn)
+			if len(m) > 0 {
+				tasks = append(tasks, m[1])
+			}
+		}
+		return true
+	})
 
 	if err != nil {
 		return tasks, err
 	}
 
-	for _, taskArn := range result.TaskArns {
-		re := regexp.MustCompile(`^arn:aws:ecs:.*:.*:task/(.*)$`)
-		m := re.FindStringSubmatch(*taskArn)
-		if len(m) > 0 {
-			tasks = append(tasks, m[1])
+	return tasks, nil
+}
+
+// GetEcsInstanceTasksInfo - get info about tasks running on instance (or on all
+// instances in cluster if instance is empty), including whether task belongs
+// to DAEMON service and whether it has scale-in protection
+func GetEcsInstanceTasksInfo(cluster string, instance string) ([]EcsTask, error) {
+	tasksInfo := []EcsTask{}
+
+	tasks, err := GetEcsInstanceTasks(cluster, instance)
+
+	if err != nil || len(tasks) == 0 {
+		return tasksInfo, err
+	}
+
+	svc := ecs.New(session.New())
+
+	// DescribeTasks accepts up to 100 tasks
+	for _, chunk := range chunkStrings(tasks, 100) {
+		input := &ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   aws.StringSlice(chunk),
+		}
+
+		result, err := svc.DescribeTasks(input)
+
+		if err != nil {
+			return tasksInfo, err
+		}
+
+		for _, t := range result.Tasks {
+			task := EcsTask{
+				ARN:            aws.StringValue(t.TaskArn),
+				Group:          aws.StringValue(t.Group),
+				TaskDefinition: aws.StringValue(t.TaskDefinitionArn),
+				LastStatus:     aws.StringValue(t.LastStatus),
+				DesiredStatus:  aws.StringValue(t.DesiredStatus),
+			}
+
+			s := strings.Split(task.ARN, "/")
+			task.ID = s[len(s)-1]
+
+			s = strings.Split(aws.StringValue(t.ContainerInstanceArn), "/")
+			task.ContainerInstance = s[len(s)-1]
+
+			if strings.HasPrefix(task.Group, "service:") {
+				task.ServiceName = strings.TrimPrefix(task.Group, "service:")
+			}
+
+			tasksInfo = append(tasksInfo, task)
 		}
 	}
 
-	return tasks, nil
+	// Find services with DAEMON scheduling strategy
+	services := []string{}
+	serviceTasks := []string{}
+	for _, task := range tasksInfo {
+		if task.ServiceName == "" {
+			continue
+		}
+		if !common.ElementInSlice(task.ServiceName, services) {
+			services = append(services, task.ServiceName)
+		}
+		serviceTasks = append(serviceTasks, task.ARN)
+	}
+
+	daemonServices := map[string]bool{}
+
+	// DescribeServices accepts up to 10 services
+	for _, chunk := range chunkStrings(services, 10) {
+		input := &ecs.DescribeServicesInput{
+			Cluster:  aws.String(cluster),
+			Services: aws.StringSlice(chunk),
+		}
+
+		result, err := svc.DescribeServices(input)
+
+		if err != nil {
+			return tasksInfo, err
+		}
+
+		for _, s := range result.Services {
+			if aws.StringValue(s.SchedulingStrategy) == ecs.SchedulingStrategyDaemon {
+				daemonServices[aws.StringValue(s.ServiceName)] = true
+			}
+		}
+	}
+
+	// Scale-in protection is available for service tasks only. Older agents
+	// and restrictive IAM policies can make this call fail, tasks which
+	// couldn't be checked are marked, so they are never force stopped.
+	protectedTasks := map[string]*ecs.ProtectedTask{}
+	unknownTasks := map[string]bool{}
+	var protectionErr error
+
+	for _, chunk := range chunkStrings(serviceTasks, 10) {
+		input := &ecs.GetTaskProtectionInput{
+			Cluster: aws.String(cluster),
+			Tasks:   aws.StringSlice(chunk),
+		}
+
+		result, err := svc.GetTaskProtection(input)
+
+		if err != nil {
+			for _, arn := range chunk {
+				unknownTasks[arn] = true
+			}
+			protectionErr = err
+			continue
+		}
+
+		for _, pt := range result.ProtectedTasks {
+			protectedTasks[aws.StringValue(pt.TaskArn)] = pt
+		}
+	}
+
+	for i, task := range tasksInfo {
+		tasksInfo[i].Daemon = daemonServices[task.ServiceName]
+
+		if pt, ok := protectedTasks[task.ARN]; ok && aws.BoolValue(pt.ProtectionEnabled) {
+			tasksInfo[i].ProtectionEnabled = true
+			tasksInfo[i].ProtectionExpiresAt = pt.ExpirationDate
+		}
+
+		tasksInfo[i].ProtectionUnknown = unknownTasks[task.ARN]
+	}
+
+	if protectionErr != nil {
+		return tasksInfo, TaskProtectionError{Err: protectionErr}
+	}
+
+	return tasksInfo, nil
+}
+
+// chunkStrings - split slice into chunks of given size
+func chunkStrings(s []string, size int) [][]string {
+	chunks := [][]string{}
+
+	for size < len(s) {
+		s, chunks = s[size:], append(chunks, s[:size])
+	}
+
+	if len(s) > 0 {
+		chunks = append(chunks, s)
+	}
+
+	return chunks
 }
 
 // ActivateEcsContainerInstance drains instance
@@ -371,3 +585,57 @@ func DrainEcsContainerInstance(cluster string, instance string) (string, error)
 
 	return *result.ContainerInstances[0].Status, nil
 }
+
+// GetEcsClusterTags - get tags of ECS cluster
+func GetEcsClusterTags(arn string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	svc := ecs.New(session.New())
+
+	input := &ecs.ListTagsForResourceInput{
+		ResourceArn: aws.String(arn),
+	}
+
+	result, err := svc.ListTagsForResource(input)
+
+	if err != nil {
+		return tags, err
+	}
+
+	for _, t := range result.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+
+	return tags, nil
+}
+
+// TagEcsCluster - add tags to ECS cluster, existing tags with same keys are overwritten
+func TagEcsCluster(arn string, tags map[string]string) error {
+	svc := ecs.New(session.New())
+
+	input := &ecs.TagResourceInput{
+		ResourceArn: aws.String(arn),
+	}
+
+	for k, v := range tags {
+		input.Tags = append(input.Tags, &ecs.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	_, err := svc.TagResource(input)
+
+	return err
+}
+
+// UntagEcsCluster - remove tags from ECS cluster
+func UntagEcsCluster(arn string, keys []string) error {
+	svc := ecs.New(session.New())
+
+	input := &ecs.UntagResourceInput{
+		ResourceArn: aws.String(arn),
+		TagKeys:     aws.StringSlice(keys),
+	}
+
+	_, err := svc.UntagResource(input)
+
+	return err
+}
@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Maximum long polling time and number of messages received at once, allowed by SQS
+const (
+	maxSqsWait     = 20 * time.Second
+	maxSqsMessages = 10
+)
+
+// SqsMessage holds message received from SQS queue
+type SqsMessage struct {
+	ID            string
+	Body          string
+	ReceiptHandle string
+}
+
+// ReceiveSqsMessages - long poll SQS queue for messages, waiting up to given
+// duration (at most 20 seconds) for the first one
+func ReceiveSqsMessages(ctx context.Context, queueURL string, wait time.Duration) ([]SqsMessage, error) {
+	svc := sqs.New(session.New())
+
+	if wait > maxSqsWait {
+		wait = maxSqsWait
+	}
+
+	result, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(maxSqsMessages),
+		WaitTimeSeconds:     aws.Int64(int64(wait.Seconds())),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []SqsMessage{}
+	for _, m := range result.Messages {
+		messages = append(messages, SqsMessage{
+			ID:            aws.StringValue(m.MessageId),
+			Body:          aws.StringValue(m.Body),
+			ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+		})
+	}
+
+	return messages, nil
+}
+
+// DeleteSqsMessages - delete received messages from SQS queue
+func DeleteSqsMessages(queueURL string, messages []SqsMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	svc := sqs.New(session.New())
+
+	entries := []*sqs.DeleteMessageBatchRequestEntry{}
+	for i, m := range messages {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(fmt.Sprint(i)),
+			ReceiptHandle: aws.String(m.ReceiptHandle),
+		})
+	}
+
+	result, err := svc.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("Couldn't delete %d of %d message(s): %s", len(result.Failed), len(messages), aws.StringValue(result.Failed[0].Message))
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// GetCallerIdentity - get ARN of IAM user or role used to make AWS calls
+func GetCallerIdentity() (string, error) {
+	svc := sts.New(session.New())
+
+	result, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+
+	if err != nil {
+		return "", err
+	}
+
+	return *result.Arn, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+
+	"github.com/manifoldco/promptui"
+)
+
+// bulkAction holds information about action which can be run on multiple instances
+type bulkAction struct {
+	Label       string
+	Action      string
+	Destructive bool
+}
+
+// List of actions which can be run on multiple instances
+var bulkActions = []bulkAction{
+	{"Update ECS Agent", ops.ActionUpdateAgent, false},
+	{"Activate instances", ops.ActionActivate, false},
+	{"Drain instances", ops.ActionDrain, false},
+	{"Terminate instances", ops.ActionTerminate, true},
+	{"Drain and terminate instances, one by one", ops.ActionDrainAndTerminate, true},
+}
+
+// selectItem holds instance, or command, shown in multi-select menu
+type selectItem struct {
+	Label    string
+	Checked  bool
+	Instance aws.EcsInstance
+	Command  string
+}
+
+// Multi-select menu commands
+const (
+	selectDone   = "done"
+	selectAll    = "all"
+	selectNone   = "none"
+	selectCancel = "cancel"
+)
+
+// selectInstances - let user tick instances, returns selected instances
+func selectInstances(instances []aws.EcsInstance) ([]aws.EcsInstance, error) {
+	items := []*selectItem{}
+
+	for _, inst := range instances {
+		items = append(items, &selectItem{
+			Label:    fmt.Sprintf("%s [ ec2:%s | ami:%s | r:%d | p:%d | agent:%s | %s ]", inst.Name, inst.Ec2InstanceID, inst.AMI, inst.RunningTasksCount, inst.PendingTasksCount, inst.AgentVersion, inst.Status),
+			Instance: inst,
+		})
+	}
+
+	items = append(items,
+		&selectItem{Label: "Continue with selected instances", Command: selectDone},
+		&selectItem{Label: "Select all", Command: selectAll},
+		&selectItem{Label: "Select none", Command: selectNone},
+		&selectItem{Label: "Cancel", Command: selectCancel},
+	)
+
+	templates := &promptui.SelectTemplates{
+		Label:    "{{ . }}",
+		Active:   "\U00002771 {{ if .Command }}{{ .Label | cyan }}{{ else }}{{ if .Checked }}[x]{{ else }}[ ]{{ end }} {{ .Label | blue }}{{ end }} \U00002770",
+		Inactive: "  {{ if .Command }}{{ .Label | cyan }}{{ else }}{{ if .Checked }}[x]{{ else }}[ ]{{ end }} {{ .Label | blue }}{{ end }}",
+		Selected: "\U00002714 {{ .Label | blue }}",
+	}
+
+	cursor := 0
+	scroll := 0
+
+	for {
+		checked := 0
+		for _, item := range items {
+			if item.Checked {
+				checked++
+			}
+		}
+
+		prompt := promptui.Select{
+			Label:        fmt.Sprintf("Select instances (%d of %d selected, press enter to toggle)", checked, len(instances)),
+			Items:        items,
+			Templates:    templates,
+			Size:         15,
+			HideSelected: true,
+		}
+
+		i, _, err := prompt.RunCursorAt(cursor, scroll)
+
+		if err != nil {
+			return []aws.EcsInstance{}, err
+		}
+
+		cursor = i
+		scroll = prompt.ScrollPosition()
+
+		switch items[i].Command {
+		case selectDone:
+			selected := []aws.EcsInstance{}
+			for _, item := range items {
+				if item.Checked {
+					selected = append(selected, item.Instance)
+				}
+			}
+
+			if len(selected) == 0 {
+				fmt.Println(p.Warn("\U000026A0 No instances selected"))
+				continue
+			}
+
+			return selected, nil
+		case selectAll, selectNone:
+			for _, item := range items {
+				if item.Command == "" {
+					item.Checked = items[i].Command == selectAll
+				}
+			}
+		case selectCancel:
+			return []aws.EcsInstance{}, promptui.ErrAbort
+		default:
+			items[i].Checked = !items[i].Checked
+		}
+	}
+}
+
+// selectBulkAction - ask for action to run on selected instances
+func selectBulkAction() (bulkAction, error) {
+	templates := &promptui.SelectTemplates{
+		Label:    "{{ . }}",
+		Active:   "\U00002771 {{ .Label | blue }} \U00002770",
+		Inactive: "  {{ .Label | blue }}",
+		Selected: "\U00002714 {{ .Label | blue }}",
+	}
+
+	prompt := promptui.Select{
+		Label:     "[ Select action ]",
+		Items:     bulkActions,
+		Templates: templates,
+	}
+
+	i, _, err := prompt.Run()
+
+	if err != nil {
+		return bulkAction{}, err
+	}
+
+	return bulkActions[i], nil
+}
+
+// printBulkResults - print table with result of action on each instance
+func printBulkResults(results []ops.Result) {
+	failed := 0
+
+	fmt.Println()
+	fmt.Println(p.Info("\U0001F5A5  Results:"))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tEC2 INSTANCE ID\tRESULT")
+
+	for _, r := range results {
+		if r.Error != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Instance.Name, r.Instance.Ec2InstanceID, p.Error(fmt.Sprintf("\U00002717 %v", r.Error)))
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Instance.Name, r.Instance.Ec2InstanceID, p.Green(fmt.Sprintf("\U00002714 %s", r.Result)))
+		}
+	}
+
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Printf(p.Error("\U00002717 Failed on %d of %d instance(s)\n"), failed, len(results))
+	} else {
+		fmt.Printf(p.Info("\U00002714 Succeeded on all %d instance(s)\n"), len(results))
+	}
+}
+
+// runBulkAction - select instances and action, and run action on them
+func runBulkAction(ctx context.Context, op *ops.Operation, reporter *terminalReporter) {
+	instances, err := op.Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), op.Cluster.Name, err)
+		return
+	}
+
+	if len(instances) == 0 {
+		fmt.Println(p.Info("\U00002717 No instances in cluster."))
+		return
+	}
+
+	selected, err := selectInstances(instances)
+
+	if err != nil {
+		return
+	}
+
+	action, err := selectBulkAction()
+
+	if err != nil {
+		return
+	}
+
+	fmt.Printf(p.Info("\U0001F5A5  %s on %d instance(s):\n"), action.Label, len(selected))
+	for _, inst := range selected {
+		fmt.Printf("   \U0000276F %s (%s)\n", inst.Name, inst.Ec2InstanceID)
+	}
+
+	if !allowAction(op, action.Action) {
+		return
+	}
+
+	if action.Destructive {
+		if !confirmDestructive(op.Cluster, op.Options, "Are you sure you want to do this", false, "") {
+			return
+		}
+	} else if !confirm("Do you want to continue", false) {
+		return
+	}
+
+	var results []ops.Result
+
+	startTime := time.Now()
+
+	err = runWithLease(ctx, op.Cluster, action.Action, false, func(ctx context.Context) error {
+		var err error
+		results, err = op.RunOnInstances(ctx, action.Action, selected)
+		reporter.stop()
+		return err
+	})
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
+	}
+
+	if len(results) > 0 {
+		printBulkResults(results)
+	}
+
+	// Instances drained on purpose are left alone
+	if action.Action == ops.ActionDrainAndTerminate && (err != nil || hasFailed(results)) {
+		offerReactivation(op, startTime)
+	}
+}
+
+// hasFailed - returns true if action failed on some instance
+func hasFailed(results []ops.Result) bool {
+	for _, r := range results {
+		if r.Error != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/audit"
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/config"
+	"gitlab.com/mzdrale/ecs-manager/exclude"
+	"gitlab.com/mzdrale/ecs-manager/metrics"
+	"gitlab.com/mzdrale/ecs-manager/notify"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+	"gitlab.com/mzdrale/ecs-manager/output"
+	"gitlab.com/mzdrale/ecs-manager/plan"
+	"gitlab.com/mzdrale/ecs-manager/server"
+	"gitlab.com/mzdrale/ecs-manager/window"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+
+	"github.com/manifoldco/promptui"
+	flag "github.com/spf13/pflag"
+)
+
+// Exit codes
+const (
+	// Command finished successfully
+	exitOK = 0
+	// Command, or some of its actions, failed
+	exitFailed = 1
+	// Invalid command, flags or arguments
+	exitUsage = 2
+	// Command aborted, confirmation not given
+	exitAborted = 3
+)
+
+// command holds information about command which can be run without menu
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+// List of commands
+var commands = []command{
+	{"clusters list", "List ECS clusters", cmdClustersList},
+	{"instances list", "List instances in cluster", cmdInstancesList},
+	{"tasks list", "List tasks running in cluster or on instance", cmdTasksList},
+	{"instance update-agent", "Update ECS agent on instance(s)", cmdInstance(ops.ActionUpdateAgent)},
+	{"instance activate", "Activate instance(s)", cmdInstance(ops.ActionActivate)},
+	{"instance drain", "Drain instance(s)", cmdInstance(ops.ActionDrain)},
+	{"instance terminate", "Terminate instance(s)", cmdInstance(ops.ActionTerminate)},
+	{"instance drain-and-terminate", "Drain instance(s), wait for drain to finish and terminate", cmdInstance(ops.ActionDrainAndTerminate)},
+	{"cluster dashboard", "Show cluster instances, refreshed until interrupted", cmdClusterDashboard},
+	{"cluster update-agents", "Update ECS agent on all instances in cluster", cmdClusterUpdateAgents},
+	{"cluster rotate", "Drain and terminate instances in cluster, one by one", cmdClusterRotate},
+	{"cluster plan", "Write rotation plan of cluster to file, for review", cmdClusterPlan},
+	{"cluster apply", "Drain and terminate instances as planned in plan file", cmdClusterApply},
+	{"config show", "Show effective settings of cluster and where they come from", cmdConfigShow},
+	{"config validate", "Check config file for invalid keys and values and for clusters which don't exist", cmdConfigValidate},
+	{"audit query", "Show audit log entries, filtered by cluster and time range", cmdAuditQuery},
+	{"serve-metrics", "Poll clusters and serve metrics for Prometheus", cmdServeMetrics},
+	{"serve", "Serve HTTP API for listing clusters and running operations", cmdServe},
+}
+
+// printUsage - print usage
+func printUsage() {
+	prog := filepath.Base(os.Args[0])
+
+	fmt.Printf("Usage: \n")
+	fmt.Printf("  %s [flags]                            Run interactive menu\n", prog)
+	fmt.Printf("  %s [flags] <command> [command flags]  Run command\n\n", prog)
+
+	fmt.Printf("Commands: \n")
+	for _, c := range commands {
+		fmt.Printf("  %-30s %s\n", c.name, c.description)
+	}
+
+	fmt.Printf("\nFlags: \n")
+	flag.PrintDefaults()
+}
+
+// runCommand - find command by name and run it, returns exit code
+func runCommand(args []string) int {
+	for _, c := range commands {
+		name := strings.Fields(c.name)
+
+		if len(args) >= len(name) && strings.Join(args[:len(name)], " ") == c.name {
+			return c.run(args[len(name):])
+		}
+	}
+
+	fmt.Printf(p.Error("\U00002717 Unknown command: %s\n\n"), strings.Join(args, " "))
+	printUsage()
+
+	return exitUsage
+}
+
+// newCommandFlagSet - create flag set for command
+func newCommandFlagSet(name string, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s %s [flags] %s\n\nFlags:\n", filepath.Base(os.Args[0]), name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandFlags - parse command flags, exit if help is requested or flags are invalid
+func parseCommandFlags(fs *flag.FlagSet, args []string) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+}
+
+// addOutputFlag - add --output flag to command flag set
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.StringP("output", "o", output.Table, fmt.Sprintf("Output format (%s)", strings.Join(output.Formats, "|")))
+}
+
+// writeOutput - write list in format given with --output flag
+func writeOutput(format string, items interface{}, columns ...string) int {
+	if err := output.Write(os.Stdout, format, items, columns...); err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// findCluster - find cluster by name or ARN
+func findCluster(nameOrArn string) (aws.EcsCluster, error) {
+	clustersInfo, err := aws.GetEcsClustersInfo([]string{nameOrArn})
+
+	if err != nil {
+		return aws.EcsCluster{}, err
+	}
+
+	if len(clustersInfo) == 0 {
+		return aws.EcsCluster{}, fmt.Errorf("Cluster %s not found", nameOrArn)
+	}
+
+	return clustersInfo[0], nil
+}
+
+// confirm - ask for confirmation, unless it's already given with --yes
+func confirm(label string, yes bool) bool {
+	if yes {
+		return true
+	}
+
+	if !common.IsTerminal(os.Stdin) {
+		fmt.Println(p.Error("\U00002717 Confirmation required, use --yes to run without terminal"))
+		return false
+	}
+
+	prompt := promptui.Prompt{
+		Label:     label,
+		IsConfirm: true,
+	}
+
+	result, err := prompt.Run()
+
+	return err == nil && result == "y"
+}
+
+// confirmDestructive - ask for confirmation of action which terminates
+// instances. On protected clusters --yes is not enough, cluster name has to be
+// typed, or given with --confirm-cluster.
+func confirmDestructive(clust aws.EcsCluster, opts ops.Options, label string, yes bool, confirmCluster string) bool {
+	if !opts.Protected {
+		return confirm(label, yes)
+	}
+
+	if confirmCluster != "" {
+		if confirmCluster != clust.Name {
+			fmt.Printf(p.Error("\U00002717 Cluster name %s doesn't match cluster %s\n"), confirmCluster, clust.Name)
+			return false
+		}
+		return true
+	}
+
+	if !common.IsTerminal(os.Stdin) {
+		fmt.Printf(p.Error("\U00002717 Cluster %s is protected, use --confirm-cluster <cluster name> to run without terminal\n"), clust.Name)
+		return false
+	}
+
+	return confirmClusterName(clust)
+}
+
+// confirmClusterName - ask user to type cluster name
+func confirmClusterName(clust aws.EcsCluster) bool {
+	fmt.Printf(p.Warn("\U0001F512 Cluster %s is protected\n"), clust.Name)
+
+	prompt := promptui.Prompt{
+		Label: fmt.Sprintf("Type cluster name (%s) to confirm", clust.Name),
+	}
+
+	result, err := prompt.Run()
+
+	if err != nil {
+		return false
+	}
+
+	if strings.TrimSpace(result) != clust.Name {
+		fmt.Println(p.Error("\U00002717 Cluster name doesn't match, aborted"))
+		return false
+	}
+
+	return true
+}
+
+// printNotAllowed - print why action is not allowed, and how to override change windows
+func printNotAllowed(err error) {
+	fmt.Printf(p.Error("\U00002717 %v\n"), err)
+
+	var closed window.ClosedError
+	if errors.As(err, &closed) {
+		fmt.Println(p.Grey("   Use --override-window <reason> to run it anyway, reason is written to audit log"))
+	}
+}
+
+// commandCluster - get cluster from --cluster flag
+func commandCluster(fs *flag.FlagSet, nameOrArn string) (aws.EcsCluster, int) {
+	if nameOrArn == "" {
+		fmt.Println(p.Error("\U00002717 Cluster not specified, use --cluster"))
+		fs.Usage()
+		return aws.EcsCluster{}, exitUsage
+	}
+
+	clust, err := findCluster(nameOrArn)
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get cluster %s: %v\n"), nameOrArn, err)
+		return clust, exitFailed
+	}
+
+	return clust, exitOK
+}
+
+// cmdClustersList - list ECS clusters
+func cmdClustersList(args []string) int {
+	fs := newCommandFlagSet("clusters list", "")
+	format := addOutputFlag(fs)
+	parseCommandFlags(fs, args)
+
+	if !output.IsValidFormat(*format) {
+		fmt.Printf(p.Error("\U00002717 Unsupported output format: %s\n"), *format)
+		return exitUsage
+	}
+
+	clusters, err := aws.GetEcsClusters()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of ECS clusters: %v\n"), err)
+		return exitFailed
+	}
+
+	clustersInfo := []aws.EcsCluster{}
+
+	if len(clusters) > 0 {
+		clustersInfo, err = aws.GetEcsClustersInfo(clusters)
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Couldn't get list of ECS clusters: %v\n"), err)
+			return exitFailed
+		}
+	}
+
+	return writeOutput(*format, clustersInfo, "name", "status", "registered_instances_count", "running_tasks_count", "pending_tasks_count", "active_services_count")
+}
+
+// cmdInstancesList - list instances in cluster
+func cmdInstancesList(args []string) int {
+	fs := newCommandFlagSet("instances list", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	allClusters := fs.Bool("all-clusters", false, "List instances of all clusters")
+	format := addOutputFlag(fs)
+	parseCommandFlags(fs, args)
+
+	if !output.IsValidFormat(*format) {
+		fmt.Printf(p.Error("\U00002717 Unsupported output format: %s\n"), *format)
+		return exitUsage
+	}
+
+	if *allClusters {
+		instances, err := getAllClustersInstances()
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 %v\n"), err)
+			return exitFailed
+		}
+
+		return writeOutput(*format, instances, "cluster", "name", "ec2_instance_id", "status", "ami", "agent_version", "running_tasks_count", "pending_tasks_count")
+	}
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	instances, err := ops.New(clust, ops.Options{}, nil).Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+		return exitFailed
+	}
+
+	return writeOutput(*format, instances, "name", "ec2_instance_id", "status", "ami", "agent_version", "running_tasks_count", "pending_tasks_count", "remaining_cpu", "remaining_memory")
+}
+
+// cmdTasksList - list tasks running in cluster or on instance
+func cmdTasksList(args []string) int {
+	fs := newCommandFlagSet("tasks list", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	instanceID := fs.StringP("instance", "i", "", "Container instance ID or EC2 instance ID (default all instances)")
+	format := addOutputFlag(fs)
+	parseCommandFlags(fs, args)
+
+	if !output.IsValidFormat(*format) {
+		fmt.Printf(p.Error("\U00002717 Unsupported output format: %s\n"), *format)
+		return exitUsage
+	}
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	instance := ""
+
+	if *instanceID != "" {
+		instances, err := ops.New(clust, ops.Options{}, nil).FindInstances([]string{*instanceID})
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 %v\n"), err)
+			return exitFailed
+		}
+
+		instance = instances[0].Name
+	}
+
+	tasks, err := aws.GetEcsInstanceTasksInfo(clust.ARN, instance)
+
+	var protectionErr aws.TaskProtectionError
+	if errors.As(err, &protectionErr) {
+		fmt.Fprintf(os.Stderr, p.Warn("\U000026A0 %v, protection_unknown is set for those tasks\n"), err)
+		err = nil
+	}
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of tasks in ECS cluster %s: %v\n"), clust.Name, err)
+		return exitFailed
+	}
+
+	return writeOutput(*format, tasks, "id", "container_instance", "service_name", "last_status", "daemon", "protection_enabled", "protection_unknown")
+}
+
+// cmdInstance - create command running action on instance(s)
+func cmdInstance(action string) func(args []string) int {
+	return func(args []string) int {
+		fs := newCommandFlagSet("instance "+action, "<instance-id>...")
+		clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+		yes := fs.BoolP("yes", "y", false, "Don't ask for confirmation")
+		confirmCluster := fs.String("confirm-cluster", "", "Cluster name, confirms destructive action on protected cluster")
+		overrideWindow := fs.String("override-window", "", "Reason for running action outside of change windows, written to audit log")
+		takeOver := fs.Bool("take-over-lock", false, "Take over cluster lock held by someone else")
+		parseCommandFlags(fs, args)
+
+		clust, rc := commandCluster(fs, *clusterName)
+		if rc != exitOK {
+			return rc
+		}
+
+		if fs.NArg() == 0 {
+			fmt.Println(p.Error("\U00002717 Instance not specified"))
+			fs.Usage()
+			return exitUsage
+		}
+
+		opts := getClusterOptions(clust.ARN)
+		opts.OverrideReason = *overrideWindow
+
+		reporter := newTerminalReporter()
+		op := ops.New(clust, opts, reporter)
+		if common.IsTerminal(os.Stdin) {
+			op.Pause = reporter.pause
+		}
+
+		if err := op.Allowed(action); err != nil {
+			printNotAllowed(err)
+			return exitFailed
+		}
+
+		instances, err := op.FindInstances(fs.Args())
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 %v\n"), err)
+			return exitFailed
+		}
+
+		if ops.IsDestructive(action) {
+			if !confirmDestructive(clust, op.Options, "Are you sure you want to do this", *yes, *confirmCluster) {
+				return exitAborted
+			}
+		}
+
+		startTime := time.Now()
+
+		var results []ops.Result
+
+		err = runWithLease(context.Background(), clust, action, *takeOver, func(ctx context.Context) error {
+			var err error
+			results, err = op.RunOnInstances(ctx, action, instances)
+			reporter.stop()
+			return err
+		})
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 %v\n"), err)
+		}
+
+		if len(results) > 0 {
+			printBulkResults(results)
+		}
+		printDuration(startTime)
+
+		// Instances drained on purpose are left alone
+		if action == ops.ActionDrainAndTerminate && (err != nil || hasFailed(results)) {
+			offerReactivation(op, startTime)
+		}
+
+		if err != nil || hasFailed(results) {
+			return exitFailed
+		}
+
+		return exitOK
+	}
+}
+
+// cmdClusterDashboard - show dashboard until interrupted
+func cmdClusterDashboard(args []string) int {
+	fs := newCommandFlagSet("cluster dashboard", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	interval := fs.Int("interval", int(dashboardInterval.Seconds()), "Refresh interval in seconds")
+	parseCommandFlags(fs, args)
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	if *interval <= 0 {
+		fmt.Println(p.Error("\U00002717 Interval must be greater than 0"))
+		return exitUsage
+	}
+
+	newDashboard(clust, time.Duration(*interval)*time.Second, "Press Ctrl-C to quit").run(context.Background(), nil)
+
+	return exitOK
+}
+
+// cmdClusterUpdateAgents - update ECS agent on all instances in cluster
+func cmdClusterUpdateAgents(args []string) int {
+	fs := newCommandFlagSet("cluster update-agents", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	parseCommandFlags(fs, args)
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	reporter := newTerminalReporter()
+	op := ops.New(clust, getClusterOptions(clust.ARN), reporter)
+
+	startTime := time.Now()
+	err := op.UpdateAgents(context.Background())
+	reporter.stop()
+	printOperationError(err)
+	printDuration(startTime)
+
+	if err != nil && err != ops.ErrNoInstances {
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+// rotationFlags holds flags shared by cluster rotate and cluster plan
+type rotationFlags struct {
+	excludeFile        *string
+	excludeRules       *[]string
+	noExclude          *bool
+	forceStopTasks     *bool
+	waitForTask        *bool
+	zeroTasksInstances *int
+	delay              *int
+	stopDaemonTasks    *bool
+	waitTimeout        *int
+}
+
+// addRotationFlags - add flags overriding cluster settings and selecting excluded instances
+func addRotationFlags(fs *flag.FlagSet) *rotationFlags {
+	return &rotationFlags{
+		excludeFile:        fs.String("exclude-file", "", "File with list of excluded instances (default <config dir>/<cluster>-instances.exclude)"),
+		excludeRules:       fs.StringArray("exclude", []string{}, "Exclusion rule, same as line in exclude file, can be repeated"),
+		noExclude:          fs.Bool("no-exclude", false, "Don't read list of excluded instances from file"),
+		forceStopTasks:     fs.Bool("force-stop-tasks", false, "Force stop tasks instead of waiting for drain to finish (default from test_cluster)"),
+		waitForTask:        fs.Bool("wait-for-task", false, "Wait for instances to start task before proceeding to the next one (default from wait_for_task)"),
+		zeroTasksInstances: fs.Int("zero-tasks-instances", 0, "Number of instances allowed to have 0 tasks running (default from number_of_zero_tasks_instances)"),
+		delay:              fs.Int("delay", 0, "Delay in seconds before proceeding to the next instance (default from drain_and_terminate_delay)"),
+		stopDaemonTasks:    fs.Bool("stop-daemon-tasks", false, "Stop tasks of DAEMON services once all other tasks are gone (default from stop_daemon_tasks)"),
+		waitTimeout:        fs.Int("wait-timeout", 0, "Timeout in seconds for drain, termination and replacement of instance (default from wait_timeout)"),
+	}
+}
+
+// options - override cluster settings from config file with flags which are set
+func (rf *rotationFlags) options(fs *flag.FlagSet, opts ops.Options) ops.Options {
+	if fs.Changed("force-stop-tasks") {
+		opts.ForceStopTasks = *rf.forceStopTasks
+	}
+	if fs.Changed("wait-for-task") {
+		opts.WaitForTask = *rf.waitForTask
+	}
+	if fs.Changed("zero-tasks-instances") {
+		opts.NumberOfZeroTasksInstances = *rf.zeroTasksInstances
+	}
+	if fs.Changed("delay") {
+		opts.DrainAndTerminateDelay = time.Duration(*rf.delay) * time.Second
+	}
+	if fs.Changed("stop-daemon-tasks") {
+		opts.StopDaemonTasks = *rf.stopDaemonTasks
+	}
+	if fs.Changed("wait-timeout") {
+		opts.WaitTimeout = time.Duration(*rf.waitTimeout) * time.Second
+	}
+
+	return opts
+}
+
+// excluded - get instances excluded by rules given with flags and rules in
+// exclude file. Returns false if rules couldn't be read or some are invalid.
+func (rf *rotationFlags) excluded(clust aws.EcsCluster, instances []aws.EcsInstance) ([]excludedInstance, bool) {
+	rules := exclude.Rules{}
+	invalidRulesCount := 0
+
+	for _, e := range *rf.excludeRules {
+		r, parseErrors, _ := exclude.Parse(strings.NewReader(e))
+
+		for _, pe := range parseErrors {
+			fmt.Printf(p.Error("\U00002717 Invalid exclusion rule %q: %s\n"), e, pe.Err)
+		}
+
+		rules = append(rules, r...)
+		invalidRulesCount += len(parseErrors)
+	}
+
+	if !*rf.noExclude {
+		excludeFilename := getExcludeFilename(clust)
+		if *rf.excludeFile != "" {
+			excludeFilename = *rf.excludeFile
+		}
+
+		r, n, err := readExcludeRules(excludeFilename)
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Couldn't get list of excluded instances from %s: %v\n"), excludeFilename, err)
+			return nil, false
+		}
+
+		rules = append(rules, r...)
+		invalidRulesCount += n
+	}
+
+	// Don't risk terminating instances which were supposed to be excluded
+	if invalidRulesCount > 0 {
+		fmt.Println(p.Error("\U00002717 Fix invalid exclusion rules first"))
+		return nil, false
+	}
+
+	excludedInstances, err := getExcludedInstances(rules, instances)
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of excluded instances: %v\n"), err)
+		return nil, false
+	}
+
+	return excludedInstances, true
+}
+
+// cmdClusterRotate - drain and terminate instances in cluster, one by one
+func cmdClusterRotate(args []string) int {
+	fs := newCommandFlagSet("cluster rotate", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	yes := fs.BoolP("yes", "y", false, "Don't ask for confirmation")
+	confirmCluster := fs.String("confirm-cluster", "", "Cluster name, confirms rotation of protected cluster")
+	overrideWindow := fs.String("override-window", "", "Reason for rotating cluster outside of change windows, written to audit log")
+	rf := addRotationFlags(fs)
+	takeOver := fs.Bool("take-over-lock", false, "Take over cluster lock held by someone else")
+	report := fs.String("report", "", "Write rotation report to file, HTML if it ends with .html, Markdown otherwise")
+	parseCommandFlags(fs, args)
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	// Command line flags override settings from config file
+	opts := getClusterOptions(clust.ARN)
+
+	opts.OverrideReason = *overrideWindow
+
+	if err := ops.New(clust, opts, nil).Allowed(ops.ActionRotate); err != nil {
+		printNotAllowed(err)
+		return exitFailed
+	}
+
+	opts = rf.options(fs, opts)
+
+	instances, err := ops.New(clust, opts, nil).Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+		return exitFailed
+	}
+
+	excludedInstances, ok := rf.excluded(clust, instances)
+	if !ok {
+		return exitFailed
+	}
+
+	opts.Excluded = excludedInstanceIDs(excludedInstances)
+
+	printClusterOptions(opts)
+
+	if len(excludedInstances) > 0 {
+		fmt.Printf(p.Warn("\U000026A0 Excluded instances:\n"))
+		printExcludedInstances(excludedInstances)
+	}
+
+	if !confirmDestructive(clust, opts, fmt.Sprintf("Drain and terminate instances in cluster %s, one by one%s", clust.Name, rotationEstimate(clust, len(instances)-len(excludedInstances))), *yes, *confirmCluster) {
+		return exitAborted
+	}
+
+	return runRotation(clust, opts, *takeOver, *report)
+}
+
+// cmdClusterPlan - write rotation plan of cluster to file
+func cmdClusterPlan(args []string) int {
+	fs := newCommandFlagSet("cluster plan", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	outFile := fs.StringP("file", "f", "", "Plan file, - for stdout (default <cluster>-rotation-plan.yaml)")
+	rf := addRotationFlags(fs)
+	parseCommandFlags(fs, args)
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	opts := rf.options(fs, getClusterOptions(clust.ARN))
+
+	instances, err := ops.New(clust, opts, nil).Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+		return exitFailed
+	}
+
+	if len(instances) == 0 {
+		printOperationError(ops.ErrNoInstances)
+		return exitFailed
+	}
+
+	excludedInstances, ok := rf.excluded(clust, instances)
+	if !ok {
+		return exitFailed
+	}
+
+	excluded := map[string]string{}
+	for _, e := range excludedInstances {
+		excluded[e.Instance.Name] = e.Rule.Text
+	}
+
+	pl := plan.New(clust, opts, instances, excluded)
+
+	filename := *outFile
+	if filename == "" {
+		filename = fmt.Sprintf("%s-rotation-plan.yaml", clust.Name)
+	}
+
+	if err := pl.Write(filename); err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't write plan to %s: %v\n"), filename, err)
+		return exitFailed
+	}
+
+	if filename != "-" {
+		fmt.Printf(p.Info("\U00002714 Plan written to %s: %s\n"), filename, pl)
+	}
+
+	return exitOK
+}
+
+// cmdClusterApply - drain and terminate instances as planned in plan file,
+// refusing to run if instances in cluster changed since plan was created
+func cmdClusterApply(args []string) int {
+	fs := newCommandFlagSet("cluster apply", "")
+	planFile := fs.StringP("plan", "p", "", "Plan file written by cluster plan")
+	yes := fs.BoolP("yes", "y", false, "Don't ask for confirmation")
+	confirmCluster := fs.String("confirm-cluster", "", "Cluster name, confirms rotation of protected cluster")
+	overrideWindow := fs.String("override-window", "", "Reason for rotating cluster outside of change windows, written to audit log")
+	takeOver := fs.Bool("take-over-lock", false, "Take over cluster lock held by someone else")
+	report := fs.String("report", "", "Write rotation report to file, HTML if it ends with .html, Markdown otherwise")
+	parseCommandFlags(fs, args)
+
+	if *planFile == "" {
+		fmt.Println(p.Error("\U00002717 Plan file not specified, use --plan"))
+		fs.Usage()
+		return exitUsage
+	}
+
+	pl, err := plan.Read(*planFile)
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't read plan: %v\n"), err)
+		return exitFailed
+	}
+
+	if len(pl.Order()) == 0 {
+		fmt.Println(p.Info("\U00002717 All instances are excluded in plan, nothing to do."))
+		return exitOK
+	}
+
+	clust, rc := commandCluster(fs, pl.ClusterARN)
+	if rc != exitOK {
+		return rc
+	}
+
+	// Protection, change windows and hooks come from config file, the rest from plan
+	opts := getClusterOptions(clust.ARN)
+	opts.OverrideReason = *overrideWindow
+
+	if err := ops.New(clust, opts, nil).Allowed(ops.ActionRotate); err != nil {
+		printNotAllowed(err)
+		return exitFailed
+	}
+
+	opts = pl.Options(opts)
+
+	instances, err := ops.New(clust, opts, nil).Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+		return exitFailed
+	}
+
+	if drift := pl.Drift(instances); len(drift) > 0 {
+		fmt.Printf(p.Error("\U00002717 Cluster %s changed since plan was created, create a new plan:\n"), clust.Name)
+		for _, d := range drift {
+			fmt.Printf("   \U0000276F %s\n", d)
+		}
+		return exitFailed
+	}
+
+	fmt.Printf(p.Info("\U00002714 Applying plan: %s\n"), pl)
+	printClusterOptions(opts)
+
+	// Batches can have more than one instance
+	count := len(pl.Order())
+
+	if !confirmDestructive(clust, opts, fmt.Sprintf("Drain and terminate %d instances in cluster %s as planned%s", count, clust.Name, rotationEstimate(clust, count)), *yes, *confirmCluster) {
+		return exitAborted
+	}
+
+	return runRotation(clust, opts, *takeOver, *report)
+}
+
+// runRotation - drain and terminate instances in cluster while holding
+// cluster lock and write report to given file, if any. Returns exit code.
+func runRotation(clust aws.EcsCluster, opts ops.Options, takeOver bool, report string) int {
+	reporter := newTerminalReporter()
+	op := ops.New(clust, opts, withNotifications(clust, reporter))
+	if common.IsTerminal(os.Stdin) {
+		op.Pause = reporter.pause
+	}
+
+	summary, choice, err := rotateCluster(op, reporter, takeOver)
+
+	if report != "" && err != ops.ErrNoInstances {
+		if err := saveRotationReport(summary, report, reportFormat(report)); err != nil {
+			return exitFailed
+		}
+	}
+
+	// Rotation interrupted by operator
+	if choice != "" {
+		return exitAborted
+	}
+
+	if err != nil && err != ops.ErrNoInstances {
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+// cmdServeMetrics - poll clusters on interval and serve metrics on /metrics
+func cmdServeMetrics(args []string) int {
+	fs := newCommandFlagSet("serve-metrics", "")
+	listen := fs.StringP("listen", "l", ":9779", "Address to listen on")
+	interval := fs.Int("interval", 60, "Poll interval in seconds")
+	clusters := fs.StringArrayP("cluster", "c", []string{}, "Cluster name or ARN, can be repeated (default clusters in config file, or all clusters if there are none)")
+	parseCommandFlags(fs, args)
+
+	if *interval <= 0 {
+		fmt.Println(p.Error("\U00002717 Interval must be greater than 0"))
+		return exitUsage
+	}
+
+	if len(*clusters) == 0 {
+		configured, err := getConfiguredClusters()
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Couldn't get list of ECS clusters: %v\n"), err)
+			return exitFailed
+		}
+
+		*clusters = configured
+	}
+
+	exporter := metrics.New(*clusters, time.Duration(*interval)*time.Second)
+	exporter.OnError = func(err error) {
+		fmt.Printf(p.Error("%s \U00002717 %v\n"), time.Now().Format(time.RFC3339), err)
+	}
+
+	go exporter.Run(context.Background())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+
+	if len(*clusters) > 0 {
+		fmt.Printf(p.Info("\U00002714 Polling %s every %d seconds\n"), strings.Join(*clusters, ", "), *interval)
+	} else {
+		fmt.Printf(p.Info("\U00002714 Polling all clusters every %d seconds\n"), *interval)
+	}
+	fmt.Printf(p.Info("\U00002714 Serving metrics on http://%s/metrics\n"), *listen)
+
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+// cmdServe - serve HTTP API
+func cmdServe(args []string) int {
+	fs := newCommandFlagSet("serve", "")
+	listen := fs.StringP("listen", "l", "127.0.0.1:8080", "Address to listen on")
+	token := fs.String("token", os.Getenv("ECS_MANAGER_API_TOKEN"), "Token clients must send in Authorization header (default $ECS_MANAGER_API_TOKEN), required unless listening on loopback address")
+	retention := fs.Int("retention", int(server.DefaultRetention.Hours()), "Hours finished operations are kept for")
+	parseCommandFlags(fs, args)
+
+	// Without token anyone who can connect can terminate instances
+	if *token == "" && !isLoopback(*listen) {
+		fmt.Printf(p.Error("\U00002717 API token is required when listening on %s, set --token or ECS_MANAGER_API_TOKEN, or listen on loopback address\n"), *listen)
+		return exitUsage
+	}
+
+	logf := func(format string, a ...interface{}) {
+		fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, a...))
+	}
+
+	srv := server.New(*token)
+	srv.Options = func(clust aws.EcsCluster) ops.Options {
+		return getClusterOptions(clust.ARN)
+	}
+	srv.Excluded = getExcludedInstanceIDs
+	srv.Notify = func(clust aws.EcsCluster) ops.Reporter {
+		n := notify.New(clust.Name, cfg.Cluster(clust.ARN).Notifications)
+		n.OnError = func(err error) {
+			logf("%s: %v", clust.Name, err)
+		}
+		return n
+	}
+	srv.Log = logf
+	srv.Retention = time.Duration(*retention) * time.Hour
+
+	if *token == "" {
+		fmt.Println(p.Warn("\U000026A0 API token not set, anyone who can connect from this host can terminate instances"))
+	}
+	fmt.Printf(p.Info("\U00002714 Serving API on http://%s\n"), *listen)
+
+	if err := http.ListenAndServe(*listen, srv); err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+// isLoopback - returns true if listen address is loopback address, e.g.
+// 127.0.0.1:8080 or localhost:8080. Address without host listens on all
+// interfaces.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// cmdConfigValidate - check config files and clusters configured in them
+func cmdConfigValidate(args []string) int {
+	fs := newCommandFlagSet("config validate", "")
+	parseCommandFlags(fs, args)
+
+	c, err := config.LoadFiles(getConfigFiles())
+
+	if err != nil {
+		var validationErr config.ValidationError
+		if errors.As(err, &validationErr) {
+			for _, problem := range validationErr.Problems {
+				fmt.Printf(p.Error("\U00002717 %v\n"), problem)
+			}
+		} else {
+			fmt.Printf(p.Error("\U00002717 Unable to read configuration file: %v\n"), err)
+		}
+		return exitFailed
+	}
+
+	for _, w := range c.Warnings {
+		fmt.Printf(p.Warn("\U000026A0 %v\n"), w)
+	}
+
+	if len(c.Files) == 0 {
+		fmt.Printf(p.Info("\U00002714 No config file found, built-in defaults are used (create %s, or use --config or ECS_MANAGER_CONFIG)\n"), cfgFile)
+		return exitOK
+	}
+
+	// Check if configured clusters exist. Only clusters in region and account
+	// of current credentials can be checked.
+	clusters, err := aws.GetEcsClusters()
+
+	if err != nil {
+		fmt.Printf(p.Warn("\U000026A0 Couldn't get list of ECS clusters, configured clusters are not checked: %v\n"), err)
+	} else {
+		scopes := map[string]bool{}
+		for _, arn := range clusters {
+			scopes[arnScope(arn)] = true
+		}
+
+		for _, e := range c.Entries {
+			if e.Match == config.MatchDefaults {
+				continue
+			}
+
+			matched := false
+			for _, arn := range clusters {
+				if e.Matches(arn) {
+					matched = true
+					break
+				}
+			}
+
+			switch {
+			case matched:
+			case e.Match == config.MatchARN && !scopes[arnScope(e.Key)] && len(clusters) > 0:
+				fmt.Printf(p.Grey("   %s:%d: cluster %s is in another region or account, it can't be checked with current credentials\n"), e.File, e.Line, e.Key)
+			case e.Match == config.MatchARN:
+				fmt.Printf(p.Warn("\U000026A0 %s:%d: cluster %s doesn't exist\n"), e.File, e.Line, e.Key)
+			default:
+				fmt.Printf(p.Warn("\U000026A0 %s:%d: %s %s doesn't match any cluster\n"), e.File, e.Line, e.Match, e.Key)
+			}
+		}
+	}
+
+	entries := 0
+	for _, e := range c.Entries {
+		if e.Match != config.MatchDefaults {
+			entries++
+		}
+	}
+
+	fmt.Printf(p.Info("\U00002714 Config files %s are valid, %d cluster entries configured\n"), strings.Join(c.Files, ", "), entries)
+
+	return exitOK
+}
+
+// cmdConfigShow - show effective cluster settings
+func cmdConfigShow(args []string) int {
+	fs := newCommandFlagSet("config show", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN")
+	parseCommandFlags(fs, args)
+
+	clust, rc := commandCluster(fs, *clusterName)
+	if rc != exitOK {
+		return rc
+	}
+
+	printClusterSettings(clust)
+
+	return exitOK
+}
+
+// cmdAuditQuery - show audit log entries
+func cmdAuditQuery(args []string) int {
+	fs := newCommandFlagSet("audit query", "")
+	clusterName := fs.StringP("cluster", "c", "", "Cluster name or ARN (default all clusters)")
+	since := fs.String("since", "", "Show entries written at, or after, this time, e.g. 2026-10-01, 2026-10-01T08:00:00Z, 24h or 7d")
+	until := fs.String("until", "", "Show entries written before this time, in the same format as --since")
+	format := addOutputFlag(fs)
+	parseCommandFlags(fs, args)
+
+	if !output.IsValidFormat(*format) {
+		fmt.Printf(p.Error("\U00002717 Unsupported output format: %s\n"), *format)
+		return exitUsage
+	}
+
+	q := audit.Query{Cluster: *clusterName}
+	now := time.Now()
+
+	if *since != "" {
+		t, err := parseQueryTime(*since, now)
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Invalid --since: %v\n"), err)
+			return exitUsage
+		}
+		q.Since = t
+	}
+
+	if *until != "" {
+		t, err := parseQueryTime(*until, now)
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Invalid --until: %v\n"), err)
+			return exitUsage
+		}
+		q.Until = t
+	}
+
+	entries, err := audit.Read(q)
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't read audit log %s: %v\n"), audit.File(), err)
+		return exitFailed
+	}
+
+	return writeOutput(*format, entries, "time", "user", "identity", "operation_id", "cluster", "action", "target", "ec2_instance_id", "result", "error", "reason")
+}
+
+// parseQueryTime - parse time given as RFC3339 time, date in local time zone,
+// or duration before now, e.g. 24h or 7d
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	if strings.HasSuffix(s, "d") {
+		var days int
+		if n, err := fmt.Sscanf(s, "%dd", &days); err == nil && n == 1 && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("%q is not time, date or duration", s)
+}
+
+// arnScope - get region and account part of ARN
+func arnScope(arn string) string {
+	s := strings.SplitN(arn, ":", 6)
+	if len(s) < 5 {
+		return ""
+	}
+	return s[3] + ":" + s[4]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2026-10-18T08:00:00Z", want: time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)},
+		{value: "2026-10-18T08:00:00+02:00", want: time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)},
+		{value: "2026-10-18", want: time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)},
+		{value: "24h", want: now.Add(-24 * time.Hour)},
+		{value: "90m", want: now.Add(-90 * time.Minute)},
+		{value: "1h30m", want: now.Add(-90 * time.Minute)},
+		{value: "0s", want: now},
+		{value: "7d", want: time.Date(2026, 10, 12, 12, 30, 0, 0, time.UTC)},
+		{value: "0d", want: now},
+		{value: "", wantErr: true},
+		{value: "yesterday", wantErr: true},
+		{value: "-24h", wantErr: true},
+		{value: "-7d", wantErr: true},
+		{value: "7days", wantErr: true},
+		{value: "1.5d", wantErr: true},
+		{value: "2026-13-01", wantErr: true},
+		{value: "2026-10-18 08:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseQueryTime(tt.value, now)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseQueryTime = %v, want error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseQueryTime failed: %v", err)
+			}
+
+			if !got.Equal(tt.want) {
+				t.Errorf("parseQueryTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,9 @@
 package common
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"regexp"
+	"os/user"
 	"time"
 )
 
@@ -27,6 +26,31 @@ func FileExists(path string) bool {
 	return !info.IsDir()
 }
 
+// IsTerminal - returns true if file is a terminal
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// CurrentUser - get name of OS user, "unknown" if it can't be determined
+func CurrentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// Hostname - get host name, "unknown" if it can't be determined
+func Hostname() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return "unknown"
+}
+
 // FormatDuration - format duration into human readable time format
 func FormatDuration(d time.Duration) string {
 	durationString := ""
@@ -60,26 +84,3 @@ func FormatDuration(d time.Duration) string {
 	// fmt.Printf("Duration debug: %s\n", durationString)
 	return durationString
 }
-
-// ReadExcludedInstancesList - reads excluded instances list from file
-func ReadExcludedInstancesList(path string) ([]string, error) {
-	var lines []string
-	if FileExists(path) {
-		file, err := os.Open(path)
-		if err != nil {
-			return lines, err
-		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			re := regexp.MustCompile(`^(\S+)\s+\(.*\)$`)
-			m := re.FindStringSubmatch(line)
-			if len(m) > 0 {
-				lines = append(lines, m[1])
-			}
-		}
-	}
-	return lines, nil
-}
@@ -0,0 +1,608 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/custom"
+	"gitlab.com/mzdrale/ecs-manager/events"
+	"gitlab.com/mzdrale/ecs-manager/hook"
+	"gitlab.com/mzdrale/ecs-manager/notify"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+	"gitlab.com/mzdrale/ecs-manager/window"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Cluster holds cluster specific settings
+type Cluster struct {
+	// Force stop tasks instead of waiting for drain to finish
+	TestCluster bool `yaml:"test_cluster"`
+	// Wait for instances to start task before proceeding to the next one
+	WaitForTask bool `yaml:"wait_for_task"`
+	// Number of instances allowed to have 0 tasks running when waiting for task
+	NumberOfZeroTasksInstances int `yaml:"number_of_zero_tasks_instances"`
+	// Delay in seconds before proceeding to the next instance
+	DrainAndTerminateDelay int `yaml:"drain_and_terminate_delay"`
+	// Stop tasks of DAEMON services once all other tasks are gone
+	StopDaemonTasks bool `yaml:"stop_daemon_tasks"`
+	// Require cluster name to be typed to confirm destructive actions
+	Protected bool `yaml:"protected"`
+	// Actions which can't be run on cluster
+	BlockedActions []string `yaml:"blocked_actions"`
+	// Weekly windows when instances can be drained and terminated, any time if empty
+	ChangeWindows []window.Window `yaml:"change_windows"`
+	// Dates when instances can't be drained and terminated
+	Freeze []window.Freeze `yaml:"freeze"`
+	// Timeout in seconds for drain, termination and replacement of instance, no limit if 0
+	WaitTimeout int `yaml:"wait_timeout"`
+	// Webhooks notified about rotation progress
+	Notifications []notify.Target `yaml:"notifications"`
+	// Commands run before and after draining and terminating instance
+	Hooks hook.Hooks `yaml:"hooks"`
+	// User defined entries in instance and cluster menus
+	CustomActions []custom.Action `yaml:"custom_actions"`
+	// URL of SQS queue EventBridge sends ECS events to, waits only poll if empty
+	EventsQueue string `yaml:"events_queue"`
+}
+
+// Entry match types, from the lowest to the highest precedence
+const (
+	// MatchDefaults - defaults block, applies to all clusters
+	MatchDefaults = "defaults"
+	// MatchPattern - glob pattern matching cluster name, or ARN if pattern starts with "arn:"
+	MatchPattern = "pattern"
+	// MatchName - exact cluster name
+	MatchName = "name"
+	// MatchARN - exact cluster ARN
+	MatchARN = "arn"
+)
+
+// Order in which matching cluster entries of one file are applied, later ones
+// win. Defaults blocks are applied before all of them.
+var precedence = []string{MatchPattern, MatchName, MatchARN}
+
+// Entry holds settings from one block of config file. Only settings which
+// are set in config file are present.
+type Entry struct {
+	Key      string
+	Match    string
+	File     string
+	Line     int
+	Settings map[string]interface{}
+}
+
+// Setting holds effective value of cluster setting and where it comes from
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source string
+}
+
+// Config holds settings read from config files
+type Config struct {
+	// Config files, in order they are loaded
+	Files []string
+	// Defaults blocks and cluster entries, in order they are listed in config files
+	Entries []Entry
+	// Problems which don't prevent config from being used
+	Warnings []Problem
+}
+
+// Problem holds information about invalid, or suspicious, part of config file
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// Error - format problem
+func (p Problem) Error() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// ValidationError - returned when config file has invalid keys or values
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Error - format validation error
+func (e ValidationError) Error() string {
+	messages := []string{}
+	for _, p := range e.Problems {
+		messages = append(messages, p.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Line format of yaml decode errors, "line <n>: <message>"
+var reDecodeError = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Keys which are documented, but not used, they are reported and ignored
+var deprecatedKeys = map[string]string{
+	"drain_and_terminate_batch_size": "instances are always drained and terminated one by one",
+}
+
+// New - create empty config
+func New() *Config {
+	return &Config{
+		Files:    []string{},
+		Entries:  []Entry{},
+		Warnings: []Problem{},
+	}
+}
+
+// Load - read and validate config file
+func Load(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(filename, data)
+}
+
+// LoadFiles - read, validate and merge config files. Cluster entries from
+// later files take precedence over cluster entries from earlier ones, so
+// shared config can be overridden by personal one, see Matching. Problems of
+// all files are reported.
+func LoadFiles(filenames []string) (*Config, error) {
+	cfg := New()
+	problems := []Problem{}
+
+	for _, filename := range filenames {
+		c, err := Load(filename)
+
+		if err != nil {
+			var validationErr ValidationError
+			if errors.As(err, &validationErr) {
+				problems = append(problems, validationErr.Problems...)
+				continue
+			}
+			return nil, err
+		}
+
+		cfg.Files = append(cfg.Files, c.Files...)
+		cfg.Entries = append(cfg.Entries, c.Entries...)
+		cfg.Warnings = append(cfg.Warnings, c.Warnings...)
+	}
+
+	if len(problems) > 0 {
+		return nil, ValidationError{Problems: problems}
+	}
+
+	return cfg, nil
+}
+
+// Parse - parse and validate config
+func Parse(filename string, data []byte) (*Config, error) {
+	cfg := New()
+	cfg.Files = []string{filename}
+
+	problems := []Problem{}
+	problem := func(line int, format string, a ...interface{}) {
+		problems = append(problems, Problem{File: filename, Line: line, Message: fmt.Sprintf(format, a...)})
+	}
+	warning := func(line int, format string, a ...interface{}) {
+		cfg.Warnings = append(cfg.Warnings, Problem{File: filename, Line: line, Message: fmt.Sprintf(format, a...)})
+	}
+
+	// Parse settings block and add it to config
+	addEntry := func(key *yaml.Node, value *yaml.Node, match string) {
+		settings, ps, ws := parseSettings(value)
+
+		for _, p := range ps {
+			problem(p.Line, "%s: %s", key.Value, p.Message)
+		}
+		for _, w := range ws {
+			warning(w.Line, "%s: %s", key.Value, w.Message)
+		}
+
+		if len(ps) == 0 {
+			cfg.Entries = append(cfg.Entries, Entry{
+				Key:      key.Value,
+				Match:    match,
+				File:     filename,
+				Line:     key.Line,
+				Settings: settings,
+			})
+		}
+	}
+
+	var root yaml.Node
+
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, ValidationError{Problems: []Problem{{File: filename, Message: err.Error()}}}
+	}
+
+	// Empty file is valid config without clusters
+	if len(root.Content) == 0 {
+		return cfg, nil
+	}
+
+	doc := root.Content[0]
+
+	if doc.Kind != yaml.MappingNode {
+		problem(doc.Line, "config must be a map")
+		return nil, ValidationError{Problems: problems}
+	}
+
+	for i := 0; i < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+
+		switch key.Value {
+		case "defaults":
+			addEntry(key, value, MatchDefaults)
+		case "ecs":
+			if isNull(value) {
+				continue
+			}
+
+			if value.Kind != yaml.MappingNode {
+				problem(value.Line, "ecs must be a map of cluster settings")
+				continue
+			}
+
+			seen := map[string]bool{}
+
+			for j := 0; j < len(value.Content); j += 2 {
+				k, v := value.Content[j], value.Content[j+1]
+
+				if seen[k.Value] {
+					problem(k.Line, "cluster %s is configured more than once", k.Value)
+					continue
+				}
+				seen[k.Value] = true
+
+				match := matchType(k.Value)
+
+				if _, err := path.Match(k.Value, ""); err != nil || k.Value == "" {
+					problem(k.Line, "%q is not valid cluster ARN, name or pattern", k.Value)
+					continue
+				}
+
+				addEntry(k, v, match)
+			}
+		default:
+			problem(key.Line, "unknown key %s%s", key.Value, suggest(key.Value, []string{"defaults", "ecs"}))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, ValidationError{Problems: problems}
+	}
+
+	return cfg, nil
+}
+
+// parseSettings - parse and validate settings block, returns settings which
+// are set, problems and warnings
+func parseSettings(node *yaml.Node) (map[string]interface{}, []Problem, []Problem) {
+	settings := map[string]interface{}{}
+	problems := []Problem{}
+	warnings := []Problem{}
+
+	if isNull(node) {
+		return settings, problems, warnings
+	}
+
+	if node.Kind != yaml.MappingNode {
+		problems = append(problems, Problem{Line: node.Line, Message: "cluster settings must be a map"})
+		return settings, problems, warnings
+	}
+
+	fields := fieldsByKey()
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		if reason, ok := deprecatedKeys[key.Value]; ok {
+			warnings = append(warnings, Problem{Line: key.Line, Message: fmt.Sprintf("%s is not supported and is ignored, %s", key.Value, reason)})
+			continue
+		}
+
+		f, ok := fields[key.Value]
+
+		if !ok {
+			problems = append(problems, Problem{Line: key.Line, Message: fmt.Sprintf("unknown key %s%s", key.Value, suggest(key.Value, Keys()))})
+			continue
+		}
+
+		v := reflect.New(f.Type)
+
+		if err := value.Decode(v.Interface()); err != nil {
+			problems = append(problems, decodeProblem(key, err))
+			continue
+		}
+
+		if v.Elem().Kind() == reflect.Int && v.Elem().Int() < 0 {
+			problems = append(problems, Problem{Line: key.Line, Message: fmt.Sprintf("%s can't be negative", key.Value)})
+			continue
+		}
+
+		if key.Value == "events_queue" {
+			if queueURL := v.Elem().String(); queueURL != "" {
+				if err := events.ValidateQueueURL(queueURL); err != nil {
+					problems = append(problems, Problem{Line: key.Line, Message: err.Error()})
+					continue
+				}
+			}
+		}
+
+		if key.Value == "blocked_actions" {
+			actions := append(append([]string{}, ops.Actions...), ops.ClusterActions...)
+			invalid := false
+
+			for _, a := range v.Elem().Interface().([]string) {
+				if !common.ElementInSlice(a, actions) {
+					problems = append(problems, Problem{Line: key.Line, Message: fmt.Sprintf("unknown action %s in blocked_actions%s", a, suggest(a, actions))})
+					invalid = true
+				}
+			}
+
+			if invalid {
+				continue
+			}
+		}
+
+		settings[key.Value] = v.Elem().Interface()
+	}
+
+	if n, ok := settings["number_of_zero_tasks_instances"].(int); ok && n > 0 {
+		if wait, ok := settings["wait_for_task"].(bool); ok && !wait {
+			warnings = append(warnings, Problem{Line: keyLine(node, "number_of_zero_tasks_instances"), Message: "number_of_zero_tasks_instances has no effect unless wait_for_task is true"})
+		}
+	}
+
+	return settings, problems, warnings
+}
+
+// decodeProblem - convert yaml decode error of setting to problem, keeping line number
+func decodeProblem(key *yaml.Node, err error) Problem {
+	problem := Problem{Line: key.Line, Message: err.Error()}
+
+	// Strip "yaml: unmarshal errors:" header
+	for _, line := range strings.Split(err.Error(), "\n") {
+		line = strings.TrimSpace(line)
+		if m := reDecodeError.FindStringSubmatch(line); len(m) > 0 {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+	}
+
+	return problem
+}
+
+// keyLine - get line of key in map node
+func keyLine(node *yaml.Node, key string) int {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i].Line
+		}
+	}
+	return node.Line
+}
+
+// isNull - returns true if node is empty value
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+// matchType - get match type of cluster entry key
+func matchType(key string) string {
+	switch {
+	case strings.ContainsAny(key, "*?["):
+		return MatchPattern
+	case strings.HasPrefix(key, "arn:"):
+		return MatchARN
+	}
+	return MatchName
+}
+
+// ClusterName - get cluster name from cluster ARN
+func ClusterName(arn string) string {
+	s := strings.Split(arn, "/")
+	return s[len(s)-1]
+}
+
+// Matches - returns true if entry applies to cluster with given ARN
+func (e Entry) Matches(arn string) bool {
+	switch e.Match {
+	case MatchDefaults:
+		return true
+	case MatchARN:
+		return e.Key == arn
+	case MatchName:
+		return e.Key == ClusterName(arn)
+	case MatchPattern:
+		value := ClusterName(arn)
+		if strings.HasPrefix(e.Key, "arn:") {
+			value = arn
+		}
+		ok, _ := path.Match(e.Key, value)
+		return ok
+	}
+
+	return false
+}
+
+// Source - describe entry, e.g. "pattern prod-* (config.yaml:12)"
+func (e Entry) Source() string {
+	source := e.Match
+	if e.Match != MatchDefaults {
+		source = fmt.Sprintf("%s %s", e.Match, e.Key)
+	}
+
+	if e.File != "" {
+		source = fmt.Sprintf("%s (%s:%d)", source, e.File, e.Line)
+	}
+
+	return source
+}
+
+// Matching - get entries which apply to cluster, in order they are applied.
+// Defaults blocks of all files go first, in order of files. Cluster entries
+// follow file by file, so entries from later file override entries from
+// earlier ones. Within file, patterns are applied first, then name and ARN.
+func (cfg *Config) Matching(arn string) []Entry {
+	matching := []Entry{}
+	files := []string{}
+
+	for _, e := range cfg.Entries {
+		if e.Match == MatchDefaults {
+			matching = append(matching, e)
+		}
+
+		if !common.ElementInSlice(e.File, files) {
+			files = append(files, e.File)
+		}
+	}
+
+	for _, file := range files {
+		for _, match := range precedence {
+			for _, e := range cfg.Entries {
+				if e.File == file && e.Match == match && e.Matches(arn) {
+					matching = append(matching, e)
+				}
+			}
+		}
+	}
+
+	return matching
+}
+
+// Cluster - get effective cluster settings, merged from all matching entries
+func (cfg *Config) Cluster(arn string) Cluster {
+	c, _ := cfg.Effective(arn)
+	return c
+}
+
+// Effective - get effective cluster settings and source of each setting
+func (cfg *Config) Effective(arn string) (Cluster, []Setting) {
+	c := Cluster{}
+	v := reflect.ValueOf(&c).Elem()
+	fields := fieldsByKey()
+	sources := map[string]string{}
+
+	for _, e := range cfg.Matching(arn) {
+		for key, value := range e.Settings {
+			v.FieldByIndex(fields[key].Index).Set(reflect.ValueOf(value))
+			sources[key] = e.Source()
+		}
+	}
+
+	settings := []Setting{}
+
+	for _, key := range Keys() {
+		source, ok := sources[key]
+		if !ok {
+			source = "built-in default"
+		}
+
+		settings = append(settings, Setting{
+			Key:    key,
+			Value:  v.FieldByIndex(fields[key].Index).Interface(),
+			Source: source,
+		})
+	}
+
+	return c, settings
+}
+
+// IsConfigured - returns true if cluster is matched by ARN, name or pattern
+// in config file, defaults block alone doesn't count
+func (cfg *Config) IsConfigured(arn string) bool {
+	for _, e := range cfg.Matching(arn) {
+		if e.Match != MatchDefaults {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys - get list of cluster setting keys
+func Keys() []string {
+	keys := []string{}
+	for key := range fieldsByKey() {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// fieldsByKey - get Cluster struct fields by yaml key
+func fieldsByKey() map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+
+	t := reflect.TypeOf(Cluster{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]] = t.Field(i)
+	}
+
+	return fields
+}
+
+// suggest - suggest the most similar key, if there's one which is similar enough
+func suggest(key string, keys []string) string {
+	best := ""
+	bestDistance := 4
+
+	for _, k := range keys {
+		if d := distance(key, k); d < bestDistance {
+			best = k
+			bestDistance = d
+		}
+	}
+
+	if best == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// distance - Levenshtein distance between two strings
+func distance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// minInt - smaller of two integers
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,313 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testClusterARN = "arn:aws:ecs:eu-west-1:123456789012:cluster/prod-web"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		entries  int
+		warnings int
+		problems []string
+	}{
+		{
+			name: "empty file",
+			data: "",
+		},
+		{
+			name: "empty ecs",
+			data: "ecs:\n",
+		},
+		{
+			name: "defaults and clusters",
+			data: `
+defaults:
+  wait_for_task: true
+ecs:
+  prod-*:
+    protected: true
+  prod-web:
+  arn:aws:ecs:eu-west-1:123456789012:cluster/prod-web:
+    wait_timeout: 600
+`,
+			entries: 4,
+		},
+		{
+			name:     "deprecated key",
+			data:     "defaults:\n  drain_and_terminate_batch_size: 2\n",
+			entries:  1,
+			warnings: 1,
+		},
+		{
+			name:     "zero tasks instances without waiting for task",
+			data:     "defaults:\n  wait_for_task: false\n  number_of_zero_tasks_instances: 1\n",
+			entries:  1,
+			warnings: 1,
+		},
+		{
+			name:     "config is not map",
+			data:     "- ecs\n",
+			problems: []string{"test.yaml:1: config must be a map"},
+		},
+		{
+			name:     "unknown top level key",
+			data:     "default:\n  protected: true\n",
+			problems: []string{"test.yaml:1: unknown key default"},
+		},
+		{
+			name:     "unknown setting",
+			data:     "ecs:\n  prod:\n    protectd: true\n",
+			problems: []string{"test.yaml:3: prod: unknown key protectd"},
+		},
+		{
+			name:     "invalid value",
+			data:     "ecs:\n  prod:\n    wait_timeout: soon\n",
+			problems: []string{"test.yaml:3: prod: cannot unmarshal"},
+		},
+		{
+			name:     "negative value",
+			data:     "ecs:\n  prod:\n    wait_timeout: -1\n",
+			problems: []string{"test.yaml:3: prod: wait_timeout can't be negative"},
+		},
+		{
+			name:     "unknown blocked action",
+			data:     "ecs:\n  prod:\n    blocked_actions: [explode]\n",
+			problems: []string{"test.yaml:3: prod: unknown action explode in blocked_actions"},
+		},
+		{
+			name:     "invalid events queue",
+			data:     "ecs:\n  prod:\n    events_queue: ecs-events\n",
+			problems: []string{"test.yaml:3: prod: invalid SQS queue URL"},
+		},
+		{
+			name:     "cluster configured twice",
+			data:     "ecs:\n  prod:\n  prod:\n",
+			problems: []string{"test.yaml:3: cluster prod is configured more than once"},
+		},
+		{
+			name:     "invalid pattern",
+			data:     "ecs:\n  prod-[:\n",
+			problems: []string{`test.yaml:2: "prod-[" is not valid cluster ARN, name or pattern`},
+		},
+		{
+			name: "all problems are reported",
+			data: "ecs:\n  prod:\n    protectd: true\n  test:\n    wait_timeout: -1\n",
+			problems: []string{
+				"test.yaml:3: prod: unknown key protectd",
+				"test.yaml:5: test: wait_timeout can't be negative",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse("test.yaml", []byte(tt.data))
+
+			if len(tt.problems) > 0 {
+				var validationErr ValidationError
+				if !errors.As(err, &validationErr) {
+					t.Fatalf("Parse = %v, want ValidationError", err)
+				}
+
+				if len(validationErr.Problems) != len(tt.problems) {
+					t.Fatalf("problems = %v, want %v", validationErr.Problems, tt.problems)
+				}
+
+				for i, p := range validationErr.Problems {
+					if !strings.HasPrefix(p.Error(), tt.problems[i]) {
+						t.Errorf("problem = %q, want %q", p.Error(), tt.problems[i])
+					}
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			if len(cfg.Entries) != tt.entries {
+				t.Errorf("%d entries, want %d", len(cfg.Entries), tt.entries)
+			}
+
+			if len(cfg.Warnings) != tt.warnings {
+				t.Errorf("warnings = %v, want %d", cfg.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestMatchType(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "prod-web", want: MatchName},
+		{key: "prod-*", want: MatchPattern},
+		{key: testClusterARN, want: MatchARN},
+		{key: "arn:aws:ecs:*:123456789012:cluster/prod-*", want: MatchPattern},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := matchType(tt.key); got != tt.want {
+				t.Errorf("matchType = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatching(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		// Effective wait_timeout, every entry sets it to different value
+		want int
+		// Matching entries, in order they are applied
+		sources []string
+	}{
+		{
+			name:    "defaults only",
+			files:   []string{"defaults:\n  wait_timeout: 1\n"},
+			want:    1,
+			sources: []string{"defaults"},
+		},
+		{
+			name: "name over pattern, regardless of order",
+			files: []string{`
+ecs:
+  prod-web:
+    wait_timeout: 3
+  prod-*:
+    wait_timeout: 2
+defaults:
+  wait_timeout: 1
+`},
+			want:    3,
+			sources: []string{"defaults", "pattern prod-*", "name prod-web"},
+		},
+		{
+			name: "ARN over name",
+			files: []string{`
+ecs:
+  arn:aws:ecs:eu-west-1:123456789012:cluster/prod-web:
+    wait_timeout: 4
+  prod-web:
+    wait_timeout: 3
+`},
+			want:    4,
+			sources: []string{"name prod-web", "arn " + testClusterARN},
+		},
+		{
+			name: "ARN pattern",
+			files: []string{`
+ecs:
+  arn:aws:ecs:eu-west-1:*:cluster/prod-*:
+    wait_timeout: 2
+  arn:aws:ecs:us-east-1:*:cluster/prod-*:
+    wait_timeout: 5
+`},
+			want:    2,
+			sources: []string{"pattern arn:aws:ecs:eu-west-1:*:cluster/prod-*"},
+		},
+		{
+			name:    "other clusters",
+			files:   []string{"ecs:\n  prod-api:\n    wait_timeout: 3\n  test-*:\n    wait_timeout: 2\n"},
+			want:    0,
+			sources: []string{},
+		},
+		{
+			name: "later file overrides earlier file",
+			files: []string{
+				"ecs:\n  arn:aws:ecs:eu-west-1:123456789012:cluster/prod-web:\n    wait_timeout: 4\n",
+				"ecs:\n  prod-*:\n    wait_timeout: 2\n",
+			},
+			want:    2,
+			sources: []string{"arn " + testClusterARN, "pattern prod-*"},
+		},
+		{
+			name: "defaults of later file don't override clusters of earlier file",
+			files: []string{
+				"ecs:\n  prod-web:\n    wait_timeout: 3\n",
+				"defaults:\n  wait_timeout: 1\n",
+			},
+			want:    3,
+			sources: []string{"defaults", "name prod-web"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadFiles(t, tt.files)
+
+			sources := []string{}
+			for _, e := range cfg.Matching(testClusterARN) {
+				sources = append(sources, strings.SplitN(e.Source(), " (", 2)[0])
+			}
+
+			if strings.Join(sources, "; ") != strings.Join(tt.sources, "; ") {
+				t.Errorf("matching = %v, want %v", sources, tt.sources)
+			}
+
+			c, settings := cfg.Effective(testClusterARN)
+
+			if c.WaitTimeout != tt.want {
+				t.Errorf("wait_timeout = %d, want %d", c.WaitTimeout, tt.want)
+			}
+
+			for _, s := range settings {
+				if s.Key != "wait_timeout" {
+					continue
+				}
+
+				want := "built-in default"
+				if len(tt.sources) > 0 {
+					want = tt.sources[len(tt.sources)-1]
+				}
+
+				if !strings.HasPrefix(s.Source, want) {
+					t.Errorf("wait_timeout comes from %s, want %s", s.Source, want)
+				}
+			}
+
+			configured := false
+			for _, source := range tt.sources {
+				configured = configured || source != MatchDefaults
+			}
+
+			if got := cfg.IsConfigured(testClusterARN); got != configured {
+				t.Errorf("IsConfigured = %v, want %v", got, configured)
+			}
+		})
+	}
+}
+
+// loadFiles - write config files to temporary directory and load them in order
+func loadFiles(t *testing.T, files []string) *Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	filenames := []string{}
+
+	for i, data := range files {
+		filename := filepath.Join(dir, string(rune('a'+i))+".yaml")
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	cfg, err := LoadFiles(filenames)
+	if err != nil {
+		t.Fatalf("LoadFiles failed: %v", err)
+	}
+
+	return cfg
+}
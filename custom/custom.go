@@ -0,0 +1,151 @@
+package custom
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"text/template"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Menus custom action can be added to
+const (
+	// MenuInstance - instance menu, command is rendered against aws.EcsInstance
+	MenuInstance = "instance"
+	// MenuCluster - cluster menu, command is rendered against aws.EcsCluster
+	MenuCluster = "cluster"
+)
+
+// Action holds user defined menu entry running shell command
+type Action struct {
+	// Menu entry
+	Name string `yaml:"name"`
+	// Menu entry is added to, instance or cluster
+	Menu string `yaml:"menu"`
+	// Shell command, Go template rendered against instance or cluster.
+	// Values should be quoted with quote function.
+	Command string `yaml:"command"`
+	// Ask for confirmation before running command
+	Confirm bool `yaml:"confirm"`
+}
+
+// UnmarshalYAML - decode action, rejecting unknown keys and invalid values
+func (a *Action) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("custom action must be a map")
+	}
+
+	keys := []string{"name", "menu", "command", "confirm"}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		if !common.ElementInSlice(node.Content[i].Value, keys) {
+			return fmt.Errorf("unknown key %s in custom action, use one of: %s", node.Content[i].Value, strings.Join(keys, ", "))
+		}
+	}
+
+	type plain Action
+	if err := node.Decode((*plain)(a)); err != nil {
+		return err
+	}
+
+	if a.Menu == "" {
+		a.Menu = MenuInstance
+	}
+
+	return a.Validate()
+}
+
+// Validate - check name, menu and command of action. Command is rendered
+// against empty instance or cluster, to catch unknown fields.
+func (a Action) Validate() error {
+	if strings.TrimSpace(a.Name) == "" {
+		return fmt.Errorf("custom action name can't be empty")
+	}
+
+	if strings.TrimSpace(a.Command) == "" {
+		return fmt.Errorf("command of custom action %q can't be empty", a.Name)
+	}
+
+	var data interface{}
+
+	switch a.Menu {
+	case MenuInstance:
+		data = aws.EcsInstance{}
+	case MenuCluster:
+		data = aws.EcsCluster{}
+	default:
+		return fmt.Errorf("invalid menu %q in custom action %q, use %s or %s", a.Menu, a.Name, MenuInstance, MenuCluster)
+	}
+
+	if _, err := a.Render(data); err != nil {
+		return fmt.Errorf("invalid command of custom action %q: %v", a.Name, err)
+	}
+
+	return nil
+}
+
+// Functions available in command templates
+var funcs = template.FuncMap{
+	"quote": Quote,
+}
+
+// Quote - quote value for shell, so spaces and metacharacters in it are not
+// interpreted, e.g. {{quote .Name}}
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Render - render command against instance or cluster
+func (a Action) Render(data interface{}) (string, error) {
+	tmpl, err := template.New(a.Name).Option("missingkey=error").Funcs(funcs).Parse(a.Command)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// String - describe action, e.g. "SSM session (instance)"
+func (a Action) String() string {
+	return fmt.Sprintf("%s (%s)", a.Name, a.Menu)
+}
+
+// ForMenu - get actions added to given menu
+func ForMenu(actions []Action, menu string) []Action {
+	r := []Action{}
+
+	for _, a := range actions {
+		if a.Menu == menu {
+			r = append(r, a)
+		}
+	}
+
+	return r
+}
+
+// Run - run rendered command with sh -c, attached to terminal, so it can be
+// interactive, e.g. SSM session. Ctrl+C is left to command, it doesn't stop
+// ecs-manager while command is running.
+func Run(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	return cmd.Run()
+}
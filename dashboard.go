@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+)
+
+// Default interval between two dashboard refreshes
+const dashboardInterval = 5 * time.Second
+
+// Width of remaining CPU and memory bars
+const dashboardBarWidth = 10
+
+// Clear screen and move cursor to top left corner
+const clearScreen = "\033[H\033[2J"
+
+// dashboardCell holds text of table cell and color it's printed in
+type dashboardCell struct {
+	text  string
+	color func(...interface{}) string
+}
+
+// dashboard shows cluster instances, refreshed on interval
+type dashboard struct {
+	cluster  aws.EcsCluster
+	interval time.Duration
+	help     string
+	previous []aws.EcsInstance
+}
+
+// newDashboard - create new dashboard
+func newDashboard(clust aws.EcsCluster, interval time.Duration, help string) *dashboard {
+	if interval <= 0 {
+		interval = dashboardInterval
+	}
+
+	return &dashboard{
+		cluster:  clust,
+		interval: interval,
+		help:     help,
+	}
+}
+
+// run - refresh dashboard until context is cancelled or stop channel is closed
+func (d *dashboard) run(ctx context.Context, stop <-chan struct{}) {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+
+	for {
+		d.refresh(os.Stdout)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refresh - get cluster and instances info and draw dashboard
+func (d *dashboard) refresh(w io.Writer) {
+	var instances []aws.EcsInstance
+	var errs []string
+
+	clustersInfo, err := aws.GetEcsClustersInfo([]string{d.cluster.ARN})
+
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Couldn't get cluster info: %v", err))
+	} else if len(clustersInfo) > 0 {
+		d.cluster = clustersInfo[0]
+	}
+
+	ids, err := aws.GetEcsClusterInstances(d.cluster.ARN)
+
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Couldn't get list of instances: %v", err))
+	} else if len(ids) > 0 {
+		instances, err = aws.GetEcsClusterInstancesInfo(d.cluster.ARN, ids)
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Couldn't get list of instances: %v", err))
+		}
+	}
+
+	var b strings.Builder
+
+	b.WriteString(clearScreen)
+	fmt.Fprintf(&b, p.Info("\U0001F5A5  %s")+" %s\n", d.cluster.Name, p.Grey(fmt.Sprintf("(%s, refreshed at %s every %s)", d.cluster.Status, time.Now().Format("15:04:05"), d.interval)))
+	fmt.Fprintf(&b, "   Instances: %s  Running tasks: %s  Pending tasks: %s  Active services: %s\n\n",
+		p.White(d.cluster.RegisteredInstancesCount),
+		p.White(d.cluster.RunningTasksCount),
+		p.White(d.cluster.PendingTasksCount),
+		p.White(d.cluster.ActiveServicesCount))
+
+	for _, e := range errs {
+		fmt.Fprintf(&b, p.Error("\U00002717 %s\n"), e)
+	}
+
+	// Don't highlight anything if instances couldn't be fetched
+	if len(errs) > 0 && instances == nil {
+		fmt.Fprintf(&b, "\n%s\n", p.Grey(d.help))
+		fmt.Fprint(w, b.String())
+		return
+	}
+
+	writeDashboardTable(&b, d.rows(instances))
+
+	fmt.Fprintf(&b, "\n%s\n", p.Grey(d.help))
+	fmt.Fprint(w, b.String())
+
+	d.previous = instances
+	if d.previous == nil {
+		d.previous = []aws.EcsInstance{}
+	}
+}
+
+// rows - build table rows, highlighting changes since previous refresh
+func (d *dashboard) rows(instances []aws.EcsInstance) [][]dashboardCell {
+	plain := func(a ...interface{}) string { return fmt.Sprint(a...) }
+
+	rows := [][]dashboardCell{{
+		{"", plain},
+		{"INSTANCE", plain},
+		{"EC2 INSTANCE ID", plain},
+		{"STATUS", plain},
+		{"RUNNING", plain},
+		{"PENDING", plain},
+		{"REMAINING CPU", plain},
+		{"REMAINING MEMORY", plain},
+		{"AGENT", plain},
+		{"AMI", plain},
+	}}
+
+	previous := map[string]aws.EcsInstance{}
+	for _, inst := range d.previous {
+		previous[inst.Name] = inst
+	}
+
+	seen := map[string]bool{}
+
+	for _, inst := range instances {
+		seen[inst.Name] = true
+		prev, ok := previous[inst.Name]
+
+		// Changed values are highlighted, new instances are marked with +
+		cell := func(text string, changed bool) dashboardCell {
+			switch {
+			case d.previous != nil && !ok:
+				return dashboardCell{text, p.Green}
+			case d.previous != nil && changed:
+				return dashboardCell{text, p.Yellow}
+			}
+			return dashboardCell{text, plain}
+		}
+
+		marker := " "
+		if d.previous != nil && !ok {
+			marker = "+"
+		}
+
+		rows = append(rows, []dashboardCell{
+			cell(marker, false),
+			cell(inst.Name, false),
+			cell(inst.Ec2InstanceID, false),
+			cell(inst.Status, inst.Status != prev.Status),
+			cell(fmt.Sprint(inst.RunningTasksCount), inst.RunningTasksCount != prev.RunningTasksCount),
+			cell(fmt.Sprint(inst.PendingTasksCount), inst.PendingTasksCount != prev.PendingTasksCount),
+			cell(resourceBar(inst.RemainingCPU, inst.RegisteredCPU), inst.RemainingCPU != prev.RemainingCPU),
+			cell(resourceBar(inst.RemainingMemory, inst.RegisteredMemory), inst.RemainingMemory != prev.RemainingMemory),
+			cell(inst.AgentVersion, inst.AgentVersion != prev.AgentVersion),
+			cell(inst.AMI, inst.AMI != prev.AMI),
+		})
+	}
+
+	// Instances which are gone since previous refresh are marked with -
+	for _, inst := range d.previous {
+		if seen[inst.Name] {
+			continue
+		}
+
+		gone := func(text string) dashboardCell {
+			return dashboardCell{text, p.Red}
+		}
+
+		rows = append(rows, []dashboardCell{
+			gone("-"),
+			gone(inst.Name),
+			gone(inst.Ec2InstanceID),
+			gone("GONE"),
+			gone(""),
+			gone(""),
+			gone(""),
+			gone(""),
+			gone(inst.AgentVersion),
+			gone(inst.AMI),
+		})
+	}
+
+	return rows
+}
+
+// writeDashboardTable - write table with aligned columns. Cells are padded
+// before they are colored, so color codes don't break alignment.
+func writeDashboardTable(w io.Writer, rows [][]dashboardCell) {
+	widths := []int{}
+
+	for _, row := range rows {
+		for i, c := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if l := utf8.RuneCountInString(c.text); l > widths[i] {
+				widths[i] = l
+			}
+		}
+	}
+
+	for _, row := range rows {
+		cells := []string{}
+		for i, c := range row {
+			padded := c.text + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c.text))
+			cells = append(cells, c.color(padded))
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+}
+
+// resourceBar - draw bar showing how much of registered resource remains
+func resourceBar(remaining int64, registered int64) string {
+	if registered <= 0 {
+		return fmt.Sprint(remaining)
+	}
+
+	filled := int(remaining * dashboardBarWidth / registered)
+	if filled > dashboardBarWidth {
+		filled = dashboardBarWidth
+	}
+	if filled < 0 {
+		filled = 0
+	}
+
+	return fmt.Sprintf("%s%s %d/%d", strings.Repeat("\U00002588", filled), strings.Repeat("\U00002591", dashboardBarWidth-filled), remaining, registered)
+}
+
+// showDashboard - show dashboard until user presses enter
+func showDashboard(ctx context.Context, clust aws.EcsCluster) {
+	stop := make(chan struct{})
+
+	go func() {
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		close(stop)
+	}()
+
+	newDashboard(clust, dashboardInterval, "Press Enter to go back").run(ctx, stop)
+}
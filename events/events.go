@@ -0,0 +1,182 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+)
+
+// Detail types of ECS events sent to EventBridge
+const (
+	// TaskStateChange - task started, stopped or changed state
+	TaskStateChange = "ECS Task State Change"
+	// ContainerInstanceStateChange - container instance registered,
+	// deregistered or changed status, e.g. to DRAINING
+	ContainerInstanceStateChange = "ECS Container Instance State Change"
+)
+
+// Event holds ECS state change event, as delivered by EventBridge
+type Event struct {
+	ID         string    `json:"id"`
+	DetailType string    `json:"detail-type"`
+	Source     string    `json:"source"`
+	Time       time.Time `json:"time"`
+	Detail     Detail    `json:"detail"`
+}
+
+// Detail holds fields of task and container instance state change events
+// waits care about
+type Detail struct {
+	ClusterARN           string `json:"clusterArn"`
+	ContainerInstanceARN string `json:"containerInstanceArn"`
+	Ec2InstanceID        string `json:"ec2InstanceId,omitempty"`
+	TaskARN              string `json:"taskArn,omitempty"`
+	// Status of container instance
+	Status string `json:"status,omitempty"`
+	// Last status of task
+	LastStatus string `json:"lastStatus,omitempty"`
+}
+
+// IsStateChange - returns true if event is ECS task or container instance
+// state change in given cluster
+func (e Event) IsStateChange(clusterARN string) bool {
+	return (e.DetailType == TaskStateChange || e.DetailType == ContainerInstanceStateChange) && e.Detail.ClusterARN == clusterARN
+}
+
+// Source delivers ECS events
+type Source interface {
+	// Receive - wait until events are received, or context is done. Returns
+	// no events and no error if nothing was received before context is done.
+	Receive(ctx context.Context) ([]Event, error)
+}
+
+// SQS receives events EventBridge rule sends to SQS queue. Received messages
+// are deleted from queue, so queue shouldn't be shared with other consumers.
+type SQS struct {
+	QueueURL string
+}
+
+// NewSQS - create source receiving events from SQS queue with given URL
+func NewSQS(queueURL string) *SQS {
+	return &SQS{QueueURL: queueURL}
+}
+
+// Receive - long poll queue until events are received, or context is done.
+// Messages which are not ECS events are deleted and ignored.
+func (s *SQS) Receive(ctx context.Context) ([]Event, error) {
+	for {
+		wait := 20 * time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = time.Until(deadline).Truncate(time.Second)
+		}
+
+		// Not enough time left for long polling
+		if wait < time.Second {
+			<-ctx.Done()
+			return nil, nil
+		}
+
+		messages, err := aws.ReceiveSqsMessages(ctx, s.QueueURL, wait)
+
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		events := []Event{}
+		for _, m := range messages {
+			var e Event
+			if err := json.Unmarshal([]byte(m.Body), &e); err == nil && e.DetailType != "" {
+				events = append(events, e)
+			}
+		}
+
+		if err := aws.DeleteSqsMessages(s.QueueURL, messages); err != nil {
+			return events, err
+		}
+
+		if len(events) > 0 {
+			return events, nil
+		}
+	}
+}
+
+// String - describe source
+func (s *SQS) String() string {
+	return s.QueueURL
+}
+
+// Local is in-memory stand-in for SQS queue, events sent to it are received
+// by the next Receive. It can be used to test waits without AWS.
+type Local struct {
+	mu      sync.Mutex
+	events  []Event
+	arrived chan struct{}
+}
+
+// NewLocal - create empty local source
+func NewLocal() *Local {
+	return &Local{arrived: make(chan struct{}, 1)}
+}
+
+// Send - queue events
+func (l *Local) Send(events ...Event) {
+	l.mu.Lock()
+	l.events = append(l.events, events...)
+	l.mu.Unlock()
+
+	select {
+	case l.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// Receive - get queued events, waiting for them until context is done
+func (l *Local) Receive(ctx context.Context) ([]Event, error) {
+	for {
+		l.mu.Lock()
+		events := l.events
+		l.events = nil
+		l.mu.Unlock()
+
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-l.arrived:
+		}
+	}
+}
+
+// String - describe source
+func (l *Local) String() string {
+	return "local"
+}
+
+// ValidateQueueURL - check if URL looks like SQS queue URL,
+// e.g. https://sqs.eu-west-1.amazonaws.com/123456789012/ecs-events
+func ValidateQueueURL(queueURL string) error {
+	u, err := url.Parse(queueURL)
+
+	if err != nil || u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("invalid SQS queue URL %q, expected https://sqs.<region>.amazonaws.com/<account>/<queue>", queueURL)
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package exclude
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+)
+
+// Rule types
+const (
+	// RuleInstance - matches container instance ID
+	RuleInstance = "instance"
+	// RuleEc2 - matches EC2 instance ID
+	RuleEc2 = "ec2"
+	// RuleID - matches container instance ID or EC2 instance ID
+	RuleID = "id"
+	// RuleAMI - matches AMI ID
+	RuleAMI = "ami"
+	// RuleType - matches EC2 instance type
+	RuleType = "type"
+	// RuleTag - matches EC2 instance tag
+	RuleTag = "tag"
+)
+
+var (
+	// Line format of exported instances list, "<instance-id> (EC2:<ec2-instance-id>, AMI:<ami>)",
+	// which can be followed by options
+	reListLine = regexp.MustCompile(`^(\S+)\s+\(([^)]*)\)(.*)$`)
+	// Container instance ID, new (32 hex digits) or old (UUID) format
+	reInstanceID = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+)
+
+// Rule holds single exclusion rule
+type Rule struct {
+	Type    string
+	Key     string
+	Pattern string
+	Expires time.Time
+	Line    int
+	Text    string
+}
+
+// Rules holds list of exclusion rules
+type Rules []Rule
+
+// ParseError holds information about line which couldn't be parsed
+type ParseError struct {
+	Line int
+	Text string
+	Err  string
+}
+
+// Error - format parse error
+func (e ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Err, e.Text)
+}
+
+// ReadFile - read exclusion rules from file, missing file means no rules
+func ReadFile(filename string) (Rules, []ParseError, error) {
+	f, err := os.Open(filename)
+
+	if os.IsNotExist(err) {
+		return Rules{}, []ParseError{}, nil
+	}
+
+	if err != nil {
+		return Rules{}, []ParseError{}, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse - parse exclusion rules, one per line. Empty lines and everything
+// after # is ignored. Each rule can be followed by expires=<date> option.
+func Parse(r io.Reader) (Rules, []ParseError, error) {
+	rules := Rules{}
+	parseErrors := []ParseError{}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		text := scanner.Text()
+
+		line := text
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		rule, err := parseLine(line)
+
+		if err != nil {
+			parseErrors = append(parseErrors, ParseError{Line: lineNumber, Text: text, Err: err.Error()})
+			continue
+		}
+
+		rule.Line = lineNumber
+		rule.Text = line
+		rules = append(rules, rule)
+	}
+
+	return rules, parseErrors, scanner.Err()
+}
+
+// parseLine - parse single rule
+func parseLine(line string) (Rule, error) {
+	fields := strings.Fields(line)
+	selector, options := fields[0], fields[1:]
+
+	// Exported instances list can be used as is, options go after parentheses
+	if m := reListLine.FindStringSubmatch(line); len(m) > 0 {
+		if strings.Contains(m[2], "=") {
+			return Rule{}, fmt.Errorf("options must follow parentheses, not be inside them")
+		}
+		selector, options = m[1], strings.Fields(m[3])
+	}
+
+	rule, err := parseSelector(selector)
+
+	if err != nil {
+		return rule, err
+	}
+
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+
+		if len(kv) != 2 || (kv[0] != "expires" && kv[0] != "until") {
+			return rule, fmt.Errorf("unknown option %s", option)
+		}
+
+		expires, err := parseExpiry(kv[1])
+
+		if err != nil {
+			return rule, err
+		}
+
+		rule.Expires = expires
+	}
+
+	return rule, nil
+}
+
+// parseSelector - parse selector part of rule
+func parseSelector(selector string) (Rule, error) {
+	rule := Rule{}
+
+	if kv := strings.SplitN(selector, ":", 2); len(kv) == 2 && !strings.HasPrefix(selector, "arn:") {
+		rule.Type = kv[0]
+		rule.Pattern = kv[1]
+
+		switch rule.Type {
+		case RuleInstance, RuleEc2, RuleID, RuleAMI, RuleType:
+		case RuleTag:
+			tag := strings.SplitN(rule.Pattern, "=", 2)
+			if len(tag) != 2 || tag[0] == "" {
+				return rule, fmt.Errorf("tag rule must be in tag:<key>=<value> format")
+			}
+			rule.Key = tag[0]
+			rule.Pattern = tag[1]
+		default:
+			return rule, fmt.Errorf("unknown rule type %s", rule.Type)
+		}
+	} else {
+		// Guess rule type from value
+		switch {
+		case strings.HasPrefix(selector, "arn:"):
+			s := strings.Split(selector, "/")
+			rule.Type = RuleInstance
+			rule.Pattern = s[len(s)-1]
+		case strings.HasPrefix(selector, "i-"):
+			rule.Type = RuleEc2
+			rule.Pattern = selector
+		case strings.HasPrefix(selector, "ami-"):
+			rule.Type = RuleAMI
+			rule.Pattern = selector
+		case reInstanceID.MatchString(selector):
+			rule.Type = RuleInstance
+			rule.Pattern = selector
+		case strings.ContainsAny(selector, "*?["):
+			rule.Type = RuleID
+			rule.Pattern = selector
+		default:
+			return rule, fmt.Errorf("unknown rule")
+		}
+	}
+
+	if rule.Pattern == "" {
+		return rule, fmt.Errorf("empty pattern")
+	}
+
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return rule, fmt.Errorf("invalid pattern %s", rule.Pattern)
+	}
+
+	return rule, nil
+}
+
+// parseExpiry - parse expiry date, rule with date only expires at the end of that day
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid expiry date %s, use YYYY-MM-DD or RFC3339 format", s)
+}
+
+// IsExpired - returns true if rule is expired at given time
+func (r Rule) IsExpired(t time.Time) bool {
+	return !r.Expires.IsZero() && !t.Before(r.Expires)
+}
+
+// Matches - returns true if rule matches instance with given EC2 tags
+func (r Rule) Matches(inst aws.EcsInstance, tags map[string]string) bool {
+	match := func(value string) bool {
+		ok, _ := path.Match(r.Pattern, value)
+		return ok
+	}
+
+	switch r.Type {
+	case RuleInstance:
+		return match(inst.Name)
+	case RuleEc2:
+		return match(inst.Ec2InstanceID)
+	case RuleID:
+		return match(inst.Name) || match(inst.Ec2InstanceID)
+	case RuleAMI:
+		return match(inst.AMI)
+	case RuleType:
+		return match(inst.InstanceType)
+	case RuleTag:
+		value, ok := tags[r.Key]
+		return ok && match(value)
+	}
+
+	return false
+}
+
+// Split - split rules to active and expired ones at given time
+func (rules Rules) Split(t time.Time) (Rules, Rules) {
+	active := Rules{}
+	expired := Rules{}
+
+	for _, r := range rules {
+		if r.IsExpired(t) {
+			expired = append(expired, r)
+		} else {
+			active = append(active, r)
+		}
+	}
+
+	return active, expired
+}
+
+// NeedsTags - returns true if any rule matches EC2 instance tags
+func (rules Rules) NeedsTags() bool {
+	for _, r := range rules {
+		if r.Type == RuleTag {
+			return true
+		}
+	}
+	return false
+}
+
+// Match - returns first rule which matches instance with given EC2 tags
+func (rules Rules) Match(inst aws.EcsInstance, tags map[string]string) (Rule, bool) {
+	for _, r := range rules {
+		if r.Matches(inst, tags) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
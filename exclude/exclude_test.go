@@ -0,0 +1,189 @@
+package exclude
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	endOfDay := time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local).AddDate(0, 0, 1)
+
+	tests := []struct {
+		name    string
+		line    string
+		rule    Rule
+		wantErr string
+	}{
+		{
+			name: "container instance ID",
+			line: "0123456789abcdef0123456789abcdef",
+			rule: Rule{Type: RuleInstance, Pattern: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "old container instance ID",
+			line: "01234567-89ab-cdef-0123-456789abcdef",
+			rule: Rule{Type: RuleInstance, Pattern: "01234567-89ab-cdef-0123-456789abcdef"},
+		},
+		{
+			name: "container instance ARN",
+			line: "arn:aws:ecs:eu-west-1:123456789012:container-instance/prod/0123456789abcdef0123456789abcdef",
+			rule: Rule{Type: RuleInstance, Pattern: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "EC2 instance ID",
+			line: "i-0123456789abcdef0",
+			rule: Rule{Type: RuleEc2, Pattern: "i-0123456789abcdef0"},
+		},
+		{
+			name: "AMI",
+			line: "ami-0123456789abcdef0",
+			rule: Rule{Type: RuleAMI, Pattern: "ami-0123456789abcdef0"},
+		},
+		{
+			name: "ID pattern",
+			line: "0123*",
+			rule: Rule{Type: RuleID, Pattern: "0123*"},
+		},
+		{
+			name: "instance type",
+			line: "type:m5.*",
+			rule: Rule{Type: RuleType, Pattern: "m5.*"},
+		},
+		{
+			name: "tag",
+			line: "tag:team=payments",
+			rule: Rule{Type: RuleTag, Key: "team", Pattern: "payments"},
+		},
+		{
+			name: "comment after rule",
+			line: "i-0123456789abcdef0 # debugging",
+			rule: Rule{Type: RuleEc2, Pattern: "i-0123456789abcdef0"},
+		},
+		{
+			name: "expires date",
+			line: "i-0123456789abcdef0 expires=2026-12-31",
+			rule: Rule{Type: RuleEc2, Pattern: "i-0123456789abcdef0", Expires: endOfDay},
+		},
+		{
+			name: "until RFC3339",
+			line: "ami:ami-0123* until=2026-12-31T12:00:00Z",
+			rule: Rule{Type: RuleAMI, Pattern: "ami-0123*", Expires: time.Date(2026, 12, 31, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "list line",
+			line: "0123456789abcdef0123456789abcdef (EC2:i-0123456789abcdef0, AMI:ami-0123456789abcdef0)",
+			rule: Rule{Type: RuleInstance, Pattern: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "list line with expires",
+			line: "0123456789abcdef0123456789abcdef (EC2:i-0123456789abcdef0, AMI:ami-0123456789abcdef0) expires=2026-12-31",
+			rule: Rule{Type: RuleInstance, Pattern: "0123456789abcdef0123456789abcdef", Expires: endOfDay},
+		},
+		{
+			name:    "list line with expires inside parentheses",
+			line:    "0123456789abcdef0123456789abcdef (EC2:i-0123456789abcdef0 expires=2026-12-31)",
+			wantErr: "options must follow parentheses",
+		},
+		{
+			name:    "unknown rule type",
+			line:    "subnet:subnet-1",
+			wantErr: "unknown rule type subnet",
+		},
+		{
+			name:    "unknown rule",
+			line:    "web-1",
+			wantErr: "unknown rule",
+		},
+		{
+			name:    "tag without value",
+			line:    "tag:team",
+			wantErr: "tag rule must be in tag:<key>=<value> format",
+		},
+		{
+			name:    "empty pattern",
+			line:    "type:",
+			wantErr: "empty pattern",
+		},
+		{
+			name:    "invalid pattern",
+			line:    "type:m5[",
+			wantErr: "invalid pattern",
+		},
+		{
+			name:    "unknown option",
+			line:    "i-0123456789abcdef0 reason=debugging",
+			wantErr: "unknown option reason=debugging",
+		},
+		{
+			name:    "invalid expiry",
+			line:    "i-0123456789abcdef0 expires=tomorrow",
+			wantErr: "invalid expiry date tomorrow",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, parseErrors, err := Parse(strings.NewReader("# exclusions\n\n" + tt.line + "\n"))
+
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			if tt.wantErr != "" {
+				if len(parseErrors) != 1 || len(rules) != 0 {
+					t.Fatalf("got %d rules and %d errors, want 1 error", len(rules), len(parseErrors))
+				}
+				if parseErrors[0].Line != 3 {
+					t.Errorf("error on line %d, want 3", parseErrors[0].Line)
+				}
+				if !strings.Contains(parseErrors[0].Err, tt.wantErr) {
+					t.Errorf("error = %q, want %q", parseErrors[0].Err, tt.wantErr)
+				}
+				return
+			}
+
+			if len(parseErrors) != 0 || len(rules) != 1 {
+				t.Fatalf("got %d rules and errors %v, want 1 rule", len(rules), parseErrors)
+			}
+
+			r := rules[0]
+
+			if r.Type != tt.rule.Type || r.Key != tt.rule.Key || r.Pattern != tt.rule.Pattern {
+				t.Errorf("rule = %s %q=%q, want %s %q=%q", r.Type, r.Key, r.Pattern, tt.rule.Type, tt.rule.Key, tt.rule.Pattern)
+			}
+
+			if !r.Expires.Equal(tt.rule.Expires) {
+				t.Errorf("expires = %v, want %v", r.Expires, tt.rule.Expires)
+			}
+
+			if r.Line != 3 {
+				t.Errorf("line = %d, want 3", r.Line)
+			}
+		})
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	expires := time.Date(2026, 12, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		at      time.Time
+		want    bool
+	}{
+		{name: "never expires", at: expires, want: false},
+		{name: "before expiry", expires: expires, at: expires.Add(-time.Second), want: false},
+		{name: "at expiry", expires: expires, at: expires, want: true},
+		{name: "after expiry", expires: expires, at: expires.Add(time.Hour), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Rule{Expires: tt.expires}).IsExpired(tt.at); got != tt.want {
+				t.Errorf("IsExpired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
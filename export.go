@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/output"
+
+	"github.com/manifoldco/promptui"
+)
+
+// Format of instances list which can be used as exclude list
+const exportFormatList = "list"
+
+// exportFormat holds information about format of exported instances list
+type exportFormat struct {
+	Label     string
+	Format    string
+	Extension string
+}
+
+// List of export formats
+var exportFormats = []exportFormat{
+	{"List (can be used as exclude list)", exportFormatList, "list"},
+	{"CSV", output.CSV, "csv"},
+	{"JSON", output.JSON, "json"},
+	{"Markdown", output.Markdown, "md"},
+}
+
+// clusterInstance holds information about ECS instance and cluster it belongs to
+type clusterInstance struct {
+	Cluster         string `json:"cluster" yaml:"cluster"`
+	aws.EcsInstance `yaml:",inline"`
+}
+
+// getAllClustersInstances - get instances of all clusters
+func getAllClustersInstances() ([]clusterInstance, error) {
+	all := []clusterInstance{}
+
+	clusters, err := aws.GetEcsClusters()
+
+	if err != nil || len(clusters) == 0 {
+		return all, err
+	}
+
+	clustersInfo, err := aws.GetEcsClustersInfo(clusters)
+
+	if err != nil {
+		return all, err
+	}
+
+	for _, clust := range clustersInfo {
+		instances, err := aws.GetEcsClusterInstances(clust.ARN)
+
+		if err != nil {
+			return all, fmt.Errorf("Couldn't get list of instances in ECS cluster %s: %v", clust.Name, err)
+		}
+
+		if len(instances) == 0 {
+			continue
+		}
+
+		instancesInfo, err := aws.GetEcsClusterInstancesInfo(clust.ARN, instances)
+
+		if err != nil {
+			return all, fmt.Errorf("Couldn't get list of instances in ECS cluster %s: %v", clust.Name, err)
+		}
+
+		for _, inst := range instancesInfo {
+			all = append(all, clusterInstance{Cluster: clust.Name, EcsInstance: inst})
+		}
+	}
+
+	return all, nil
+}
+
+// promptExportFile - ask for export format and file, returns format and path
+func promptExportFile(name string, formats []exportFormat) (string, string, error) {
+	templates := &promptui.SelectTemplates{
+		Label:    "{{ . }}",
+		Active:   "\U00002771 {{ .Label | blue }} \U00002770",
+		Inactive: "  {{ .Label | blue }}",
+		Selected: "\U00002714 {{ .Label | blue }}",
+	}
+
+	prompt := promptui.Select{
+		Label:     "Select format",
+		Items:     formats,
+		Templates: templates,
+	}
+
+	i, _, err := prompt.Run()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	format := formats[i]
+
+	pathPrompt := promptui.Prompt{
+		Label:   "File",
+		Default: filepath.Join(cfgDir, fmt.Sprintf("%s.%s", name, format.Extension)),
+	}
+
+	path, err := pathPrompt.Run()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	// Expand ~ to user's home dir
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+
+	return format.Format, path, nil
+}
+
+// exportToFile - write items to file in given format
+func exportToFile(path string, format string, items interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Create file and open for writing
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if format == exportFormatList {
+		err = writeInstancesList(f, items.([]aws.EcsInstance))
+	} else {
+		err = output.Write(f, format, items)
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeInstancesList - write instances list in format which can be used as exclude list
+func writeInstancesList(f *os.File, instances []aws.EcsInstance) error {
+	for _, inst := range instances {
+		line := fmt.Sprintf("%s (EC2:%s, AMI:%s)\n", inst.Name, inst.Ec2InstanceID, inst.AMI)
+		if _, err := f.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of past rotations kept per cluster, and number of the latest ones
+// estimate is based on
+const (
+	maxRotations = 20
+	samples      = 5
+)
+
+// ErrNotConfigured - returned when history file is not set
+var ErrNotConfigured = errors.New("Rotation history file is not set")
+
+// Rotation holds finished rotation of cluster, written as one line of JSON
+type Rotation struct {
+	Time time.Time `json:"time"`
+	// Cluster ARN
+	Cluster string `json:"cluster"`
+	// Number of replaced instances
+	Replaced int `json:"replaced"`
+	// Time from start of rotation until the last instance was replaced
+	Duration time.Duration `json:"duration"`
+}
+
+// PerInstance - get average time it took to replace one instance
+func (r Rotation) PerInstance() time.Duration {
+	if r.Replaced == 0 {
+		return 0
+	}
+	return r.Duration / time.Duration(r.Replaced)
+}
+
+var (
+	mu   sync.Mutex
+	file string
+)
+
+// SetFile - set file rotations are recorded to
+func SetFile(filename string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	file = filename
+}
+
+// Record - add rotation to history, keeping only the latest rotations of
+// each cluster. Rotations which didn't replace any instance are ignored.
+func Record(r Rotation) error {
+	if r.Replaced == 0 {
+		return nil
+	}
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == "" {
+		return ErrNotConfigured
+	}
+
+	rotations, err := read()
+	if err != nil {
+		return err
+	}
+
+	rotations = append(rotations, r)
+
+	// Drop the oldest rotations of cluster
+	kept := []Rotation{}
+	count := 0
+	for i := len(rotations) - 1; i >= 0; i-- {
+		if rotations[i].Cluster == r.Cluster {
+			count++
+			if count > maxRotations {
+				continue
+			}
+		}
+		kept = append([]Rotation{rotations[i]}, kept...)
+	}
+
+	var b strings.Builder
+	for _, r := range kept {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b.Write(append(line, '\n'))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, []byte(b.String()), 0600)
+}
+
+// Rotations - get past rotations of cluster, oldest first
+func Rotations(cluster string) ([]Rotation, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == "" {
+		return nil, ErrNotConfigured
+	}
+
+	rotations, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	r := []Rotation{}
+	for _, rotation := range rotations {
+		if rotation.Cluster == cluster {
+			r = append(r, rotation)
+		}
+	}
+
+	return r, nil
+}
+
+// Estimate - get average time it took to replace one instance in the latest
+// rotations of cluster. Returns false if cluster wasn't rotated before.
+func Estimate(cluster string) (time.Duration, bool) {
+	rotations, err := Rotations(cluster)
+
+	if err != nil || len(rotations) == 0 {
+		return 0, false
+	}
+
+	if len(rotations) > samples {
+		rotations = rotations[len(rotations)-samples:]
+	}
+
+	var duration time.Duration
+	replaced := 0
+	for _, r := range rotations {
+		duration += r.Duration
+		replaced += r.Replaced
+	}
+
+	return duration / time.Duration(replaced), true
+}
+
+// read - read all rotations from history file, lines which can't be parsed
+// are skipped, so broken history doesn't stop rotation
+func read() ([]Rotation, error) {
+	rotations := []Rotation{}
+
+	f, err := os.Open(file)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return rotations, nil
+	}
+
+	if err != nil {
+		return rotations, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var r Rotation
+
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Replaced == 0 {
+			continue
+		}
+
+		rotations = append(rotations, r)
+	}
+
+	return rotations, scanner.Err()
+}
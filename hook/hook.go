@@ -0,0 +1,246 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hook stages
+const (
+	// BeforeDrain - before instance is drained
+	BeforeDrain = "before_drain"
+	// AfterDrain - after all tasks left instance
+	AfterDrain = "after_drain"
+	// BeforeTerminate - before instance is terminated
+	BeforeTerminate = "before_terminate"
+	// AfterReplacement - after instance is terminated and replaced by a new one
+	AfterReplacement = "after_replacement"
+)
+
+// Failure policies
+const (
+	// PolicyAbort - stop rotation if hook fails
+	PolicyAbort = "abort"
+	// PolicyPause - ask whether to retry hook, continue or abort rotation if hook fails
+	PolicyPause = "pause"
+)
+
+// Hook is run with timeout if it's not set, in seconds
+const defaultTimeout = 300
+
+// Hook holds command run at some stage of draining and terminating instance
+type Hook struct {
+	// Shell command, run with sh -c
+	Command string `yaml:"command"`
+	// Timeout in seconds, 300 if not set
+	Timeout int `yaml:"timeout"`
+	// What to do when command fails, abort or pause
+	OnFailure string `yaml:"on_failure"`
+}
+
+// Hooks holds hooks by stage, hooks of the same stage are run in given order
+type Hooks struct {
+	BeforeDrain      []Hook `yaml:"before_drain"`
+	AfterDrain       []Hook `yaml:"after_drain"`
+	BeforeTerminate  []Hook `yaml:"before_terminate"`
+	AfterReplacement []Hook `yaml:"after_replacement"`
+}
+
+// Payload holds information about instance, written as JSON to hook's stdin
+type Payload struct {
+	Stage         string `json:"stage"`
+	OperationID   string `json:"operation_id"`
+	Cluster       string `json:"cluster"`
+	ClusterARN    string `json:"cluster_arn"`
+	Instance      string `json:"instance"`
+	InstanceARN   string `json:"instance_arn"`
+	Ec2InstanceID string `json:"ec2_instance_id"`
+	AMI           string `json:"ami"`
+	InstanceType  string `json:"instance_type"`
+}
+
+// Error - returned when hook fails
+type Error struct {
+	Stage   string
+	Command string
+	Policy  string
+	Output  string
+	Err     error
+}
+
+// Error - format hook error, with the last line of output
+func (e Error) Error() string {
+	s := fmt.Sprintf("Hook %s %q failed: %v", e.Stage, e.Command, e.Err)
+
+	if lines := strings.Split(strings.TrimSpace(e.Output), "\n"); lines[len(lines)-1] != "" {
+		s = fmt.Sprintf("%s: %s", s, lines[len(lines)-1])
+	}
+
+	return s
+}
+
+// Unwrap - get error of command
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalYAML - decode hook, rejecting unknown keys and invalid values
+func (h *Hook) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("hook must be a map")
+	}
+
+	keys := []string{"command", "timeout", "on_failure"}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		if !common.ElementInSlice(node.Content[i].Value, keys) {
+			return fmt.Errorf("unknown key %s in hook, use one of: %s", node.Content[i].Value, strings.Join(keys, ", "))
+		}
+	}
+
+	type plain Hook
+	if err := node.Decode((*plain)(h)); err != nil {
+		return err
+	}
+
+	if h.OnFailure == "" {
+		h.OnFailure = PolicyAbort
+	}
+
+	return h.Validate()
+}
+
+// UnmarshalYAML - decode hooks, rejecting unknown stages
+func (h *Hooks) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("hooks must be a map")
+	}
+
+	stages := []string{BeforeDrain, AfterDrain, BeforeTerminate, AfterReplacement}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		if !common.ElementInSlice(node.Content[i].Value, stages) {
+			return fmt.Errorf("unknown hook stage %s, use one of: %s", node.Content[i].Value, strings.Join(stages, ", "))
+		}
+	}
+
+	type plain Hooks
+	return node.Decode((*plain)(h))
+}
+
+// Validate - check command, timeout and failure policy of hook
+func (h Hook) Validate() error {
+	if strings.TrimSpace(h.Command) == "" {
+		return fmt.Errorf("hook command can't be empty")
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("hook timeout can't be negative")
+	}
+
+	if h.OnFailure != PolicyAbort && h.OnFailure != PolicyPause {
+		return fmt.Errorf("invalid on_failure %q in hook, use %s or %s", h.OnFailure, PolicyAbort, PolicyPause)
+	}
+
+	return nil
+}
+
+// Stage - get hooks of given stage
+func (h Hooks) Stage(stage string) []Hook {
+	switch stage {
+	case BeforeDrain:
+		return h.BeforeDrain
+	case AfterDrain:
+		return h.AfterDrain
+	case BeforeTerminate:
+		return h.BeforeTerminate
+	case AfterReplacement:
+		return h.AfterReplacement
+	}
+	return nil
+}
+
+// String - describe hooks, e.g. "before_drain: deregister.sh; after_replacement: dns-cleanup.sh"
+func (h Hooks) String() string {
+	stages := []string{}
+
+	for _, stage := range []string{BeforeDrain, AfterDrain, BeforeTerminate, AfterReplacement} {
+		commands := []string{}
+		for _, c := range h.Stage(stage) {
+			commands = append(commands, c.Command)
+		}
+
+		if len(commands) > 0 {
+			stages = append(stages, fmt.Sprintf("%s: %s", stage, strings.Join(commands, ", ")))
+		}
+	}
+
+	if len(stages) == 0 {
+		return "none"
+	}
+
+	return strings.Join(stages, "; ")
+}
+
+// IsEmpty - returns true if no hook is set
+func (h Hooks) IsEmpty() bool {
+	return len(h.BeforeDrain) == 0 && len(h.AfterDrain) == 0 && len(h.BeforeTerminate) == 0 && len(h.AfterReplacement) == 0
+}
+
+// Run - run hook command with instance information in environment and as
+// JSON on stdin, returns combined stdout and stderr
+func (h Hook) Run(ctx context.Context, p Payload) (string, error) {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	stdin, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"ECS_MANAGER_HOOK="+p.Stage,
+		"ECS_MANAGER_OPERATION_ID="+p.OperationID,
+		"ECS_MANAGER_CLUSTER="+p.Cluster,
+		"ECS_MANAGER_CLUSTER_ARN="+p.ClusterARN,
+		"ECS_MANAGER_INSTANCE_ID="+p.Instance,
+		"ECS_MANAGER_INSTANCE_ARN="+p.InstanceARN,
+		"ECS_MANAGER_EC2_INSTANCE_ID="+p.Ec2InstanceID,
+		"ECS_MANAGER_AMI="+p.AMI,
+		"ECS_MANAGER_INSTANCE_TYPE="+p.InstanceType,
+	)
+
+	err = cmd.Run()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", common.FormatDuration(time.Duration(timeout)*time.Second))
+	}
+
+	if err != nil {
+		return output.String(), Error{Stage: p.Stage, Command: h.Command, Policy: h.OnFailure, Output: output.String(), Err: err}
+	}
+
+	return output.String(), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+)
+
+// What to do with interrupted operation
+const (
+	// interruptContinue - carry on as if nothing happened
+	interruptContinue = "continue"
+	// interruptFinish - finish current instance, then stop
+	interruptFinish = "finish"
+	// interruptStop - stop now and reactivate instances drained by operation
+	interruptStop = "stop"
+	// interruptAbort - stop now and leave instances as they are
+	interruptAbort = "abort"
+)
+
+// interruption holds what operator chose when operation was interrupted
+type interruption struct {
+	mu     sync.Mutex
+	choice string
+}
+
+// get - get the last choice, empty if operation wasn't interrupted
+func (i *interruption) get() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.choice
+}
+
+// set - remember choice
+func (i *interruption) set(choice string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.choice = choice
+}
+
+// interruptsKey marks context in which Ctrl-C and SIGTERM are handled by handleInterrupts
+type interruptsKey struct{}
+
+// handlesInterrupts - returns true if Ctrl-C and SIGTERM are handled by handleInterrupts
+func handlesInterrupts(ctx context.Context) bool {
+	return ctx.Value(interruptsKey{}) != nil
+}
+
+// handleInterrupts - trap Ctrl-C and SIGTERM while operation runs, stop
+// spinner and ask operator whether to continue, finish current instance and
+// stop, stop now and reactivate drained instances, or abort. Without
+// terminal, operation is aborted. Returned context is cancelled when
+// operation should stop now, returned function stops trapping signals.
+func handleInterrupts(ctx context.Context, op *ops.Operation, r *terminalReporter) (context.Context, *interruption, func()) {
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, interruptsKey{}, true))
+
+	it := &interruption{}
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				// Operation is already stopping
+				if ctx.Err() != nil {
+					continue
+				}
+
+				choice := interruptAbort
+				if common.IsTerminal(os.Stdin) {
+					choice = r.askInterrupt()
+				}
+
+				// Continuing doesn't change earlier choice
+				if choice != interruptContinue {
+					it.set(choice)
+				}
+
+				switch choice {
+				case interruptFinish:
+					op.Stop()
+				case interruptStop, interruptAbort:
+					cancel()
+				}
+			}
+		}
+	}()
+
+	return ctx, it, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
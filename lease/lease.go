@@ -0,0 +1,255 @@
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+)
+
+// Cluster tags holding lease
+const (
+	// TagID - random ID of lease
+	TagID = "ecs-manager:lease-id"
+	// TagOwner - user who holds lease
+	TagOwner = "ecs-manager:lease-owner"
+	// TagHost - host lease is held from
+	TagHost = "ecs-manager:lease-host"
+	// TagOperation - operation lease is held for
+	TagOperation = "ecs-manager:lease-operation"
+	// TagExpires - time lease expires at, unless it's renewed
+	TagExpires = "ecs-manager:lease-expires"
+)
+
+// Tags - all lease tags
+var Tags = []string{TagID, TagOwner, TagHost, TagOperation, TagExpires}
+
+// DefaultTTL - how long lease is valid if it's not renewed
+const DefaultTTL = 10 * time.Minute
+
+// Time to wait before reading lease back, so concurrent write can be noticed
+const verifyDelay = 2 * time.Second
+
+// Characters which are not allowed in tag values
+var reInvalidTagValue = regexp.MustCompile(`[^\pL\pZ\pN_.:/=+\-@]`)
+
+// ErrLost - returned when lease was taken over by someone else
+var ErrLost = errors.New("Lease was taken over by someone else")
+
+// ErrExpired - returned when lease couldn't be renewed before it expired
+var ErrExpired = errors.New("Lease couldn't be renewed and expired, someone else can take it")
+
+// Actions which can't run concurrently on the same cluster
+var actions = []string{ops.ActionDrain, ops.ActionTerminate, ops.ActionDrainAndTerminate, ops.ActionRotate}
+
+// Lease holds information about cluster-wide lock
+type Lease struct {
+	ClusterARN string
+	ID         string
+	Owner      string
+	Host       string
+	Operation  string
+	Expires    time.Time
+	TTL        time.Duration
+}
+
+// HeldError - returned when cluster is locked by someone else
+type HeldError struct {
+	Lease Lease
+}
+
+// Error - format held error
+func (e HeldError) Error() string {
+	return fmt.Sprintf("Cluster is locked by %s", e.Lease)
+}
+
+// String - describe lease
+func (l Lease) String() string {
+	return fmt.Sprintf("%s@%s (%s) until %s", l.Owner, l.Host, l.Operation, l.Expires.Local().Format(time.RFC1123))
+}
+
+// IsExpired - returns true if lease is expired at given time
+func (l Lease) IsExpired(t time.Time) bool {
+	return !t.Before(l.Expires)
+}
+
+// Required - returns true if action can't run while someone else holds lease
+func Required(action string) bool {
+	return common.ElementInSlice(action, actions)
+}
+
+// Get - get lease from cluster tags, returns false if there's no lease
+func Get(clusterArn string) (Lease, bool, error) {
+	tags, err := aws.GetEcsClusterTags(clusterArn)
+
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	if tags[TagID] == "" {
+		return Lease{}, false, nil
+	}
+
+	l := Lease{
+		ClusterARN: clusterArn,
+		ID:         tags[TagID],
+		Owner:      tags[TagOwner],
+		Host:       tags[TagHost],
+		Operation:  tags[TagOperation],
+	}
+
+	// Lease with invalid expiry time is treated as expired
+	l.Expires, _ = time.Parse(time.RFC3339, tags[TagExpires])
+
+	return l, true, nil
+}
+
+// Acquire - lock cluster for operation. If cluster is locked by someone else
+// HeldError is returned, unless force is set, in which case lease is taken over.
+func Acquire(clusterArn string, operation string, ttl time.Duration, force bool) (*Lease, error) {
+	current, ok, err := Get(clusterArn)
+
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get cluster lease: %v", err)
+	}
+
+	if ok && !current.IsExpired(time.Now()) && !force {
+		return nil, HeldError{Lease: current}
+	}
+
+	l := &Lease{
+		ClusterARN: clusterArn,
+		ID:         newID(),
+		Owner:      tagValue(common.CurrentUser()),
+		Host:       tagValue(common.Hostname()),
+		Operation:  tagValue(operation),
+		TTL:        ttl,
+	}
+
+	if err := l.write(); err != nil {
+		return nil, fmt.Errorf("Couldn't write cluster lease: %v", err)
+	}
+
+	// If someone else acquired lease at the same time, the last write wins
+	time.Sleep(verifyDelay)
+
+	current, ok, err = Get(clusterArn)
+
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get cluster lease: %v", err)
+	}
+
+	if !ok || current.ID != l.ID {
+		return nil, HeldError{Lease: current}
+	}
+
+	return l, nil
+}
+
+// Renew - extend lease, fails if lease was taken over by someone else
+func (l *Lease) Renew() error {
+	if err := l.verify(); err != nil {
+		return err
+	}
+
+	return l.write()
+}
+
+// Release - remove lease from cluster, unless it was taken over by someone else
+func (l *Lease) Release() error {
+	if err := l.verify(); err != nil {
+		return err
+	}
+
+	return aws.UntagEcsCluster(l.ClusterARN, Tags)
+}
+
+// KeepAlive - renew lease until context is cancelled. Errors are passed to
+// onError. Once lease is lost, because it was taken over by someone else or
+// because it couldn't be renewed before it expired, lost is called, so
+// operation holding lease can be stopped, and renewing is stopped.
+func (l *Lease) KeepAlive(ctx context.Context, lost func(), onError func(err error)) {
+	t := time.NewTicker(l.TTL / 3)
+	defer t.Stop()
+
+	for {
+		// Expires is only moved when lease is written successfully
+		expired := time.NewTimer(time.Until(l.Expires))
+
+		select {
+		case <-ctx.Done():
+			expired.Stop()
+			return
+		case <-expired.C:
+			onError(ErrExpired)
+			lost()
+			return
+		case <-t.C:
+			expired.Stop()
+		}
+
+		if err := l.Renew(); err != nil {
+			onError(err)
+			if err == ErrLost {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// write - write lease to cluster tags, expiry time is updated only if
+// lease is written
+func (l *Lease) write() error {
+	expires := time.Now().Add(l.TTL).UTC().Truncate(time.Second)
+
+	err := aws.TagEcsCluster(l.ClusterARN, map[string]string{
+		TagID:        l.ID,
+		TagOwner:     l.Owner,
+		TagHost:      l.Host,
+		TagOperation: l.Operation,
+		TagExpires:   expires.Format(time.RFC3339),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	l.Expires = expires
+
+	return nil
+}
+
+// verify - check if lease is still ours
+func (l *Lease) verify() error {
+	current, ok, err := Get(l.ClusterARN)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok || current.ID != l.ID {
+		return ErrLost
+	}
+
+	return nil
+}
+
+// newID - generate random lease ID
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tagValue - replace characters which are not allowed in tag values
+func tagValue(s string) string {
+	return reInvalidTagValue.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/lease"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+
+	"github.com/manifoldco/promptui"
+)
+
+// Returned when cluster is locked by someone else and lock is not taken over
+var errLocked = errors.New("Cluster is locked by someone else, operation not started")
+
+// Returned when cluster lock is taken over by someone else, or expires, while operation runs
+var errLockLost = errors.New("Cluster lock was lost, operation stopped")
+
+// runWithLease - lock cluster, run operation while renewing lease and release
+// it when operation is finished or interrupted with Ctrl-C. Operation is
+// stopped and fails if lock is lost while it runs. If cluster is locked by
+// someone else, lock is taken over only if takeOver is set or user confirms
+// it. Operations which don't need lock are just run.
+func runWithLease(ctx context.Context, clust aws.EcsCluster, operation string, takeOver bool, f func(ctx context.Context) error) error {
+	if !lease.Required(operation) {
+		return f(ctx)
+	}
+
+	fmt.Printf(p.Info("\U0001F512 Locking cluster %s\n"), clust.Name)
+
+	l, err := lease.Acquire(clust.ARN, operation, lease.DefaultTTL, takeOver)
+
+	var held lease.HeldError
+	if errors.As(err, &held) {
+		fmt.Printf(p.Warn("\U000026A0 Cluster %s is locked by %s\n"), clust.Name, held.Lease)
+
+		if !common.IsTerminal(os.Stdin) {
+			return errLocked
+		}
+
+		prompt := promptui.Prompt{
+			Label:     "Somebody else is working on this cluster, do you want to take over the lock",
+			IsConfirm: true,
+		}
+
+		if result, err := prompt.Run(); err != nil || result != "y" {
+			return errLocked
+		}
+
+		l, err = lease.Acquire(clust.ARN, operation, lease.DefaultTTL, true)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(p.Info("\U0001F512 Cluster locked by %s\n"), l)
+
+	// Stop operation on Ctrl-C, so lease can be released, unless caller asks
+	// operator what to do
+	if !handlesInterrupts(ctx) {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	}
+
+	// Operation is stopped if lock is taken over, or expires, while it runs
+	ctx, cancel := context.WithCancel(ctx)
+	var lost atomic.Bool
+
+	go l.KeepAlive(ctx, func() {
+		lost.Store(true)
+		cancel()
+	}, func(err error) {
+		fmt.Printf(p.Warn("\n\U000026A0 Couldn't renew cluster lock: %v\n"), err)
+	})
+
+	err = f(ctx)
+	cancel()
+
+	if lost.Load() {
+		return errLockLost
+	}
+
+	if err := l.Release(); err != nil {
+		fmt.Printf(p.Warn("\U000026A0 Couldn't release cluster lock: %v\n"), err)
+	} else {
+		fmt.Printf(p.Info("\U0001F513 Cluster %s unlocked\n"), clust.Name)
+	}
+
+	return err
+}
+
+// printClusterLease - warn if somebody is working on cluster
+func printClusterLease(clust aws.EcsCluster) {
+	l, ok, err := lease.Get(clust.ARN)
+
+	if err != nil {
+		fmt.Printf(p.Warn("\U000026A0 Couldn't check cluster lock: %v\n"), err)
+		return
+	}
+
+	if ok && !l.IsExpired(time.Now()) {
+		fmt.Printf(p.Warn("\U0001F512 Cluster %s is locked by %s\n"), clust.Name, l)
+	}
+}
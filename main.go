@@ -1,27 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"gitlab.com/mzdrale/ecs-manager/audit"
 	"gitlab.com/mzdrale/ecs-manager/aws"
 	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/config"
+	"gitlab.com/mzdrale/ecs-manager/custom"
+	"gitlab.com/mzdrale/ecs-manager/events"
+	"gitlab.com/mzdrale/ecs-manager/exclude"
+	"gitlab.com/mzdrale/ecs-manager/history"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+	"gitlab.com/mzdrale/ecs-manager/window"
 
 	p "gitlab.com/mzdrale/ecs-manager/prompt"
 
-	"github.com/briandowns/spinner"
 	"github.com/manifoldco/promptui"
 	flag "github.com/spf13/pflag"
-	"github.com/spf13/viper"
 )
 
 var (
 	binName string
 	cfgFile string
 	cfgDir  string
+	cfg     = config.New()
 	version string
 	pid     int
 )
@@ -35,9 +46,8 @@ var (
 
 // Config variables
 var (
-	aPrintVersion              bool
-	numberOfZeroTasksInstances int
-	drainAndTerminateDelay     int
+	aPrintVersion bool
+	aConfigFiles  []string
 )
 
 func init() {
@@ -45,35 +55,38 @@ func init() {
 	// Use config from ~/.aws
 	os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
 
-	// Get user's home dir
-	home, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Printf(p.Error("\U00002717 Unable to determine current user's home dir: %s\n\n"), err.Error())
-		os.Exit(1)
+	// Configuration dir, $XDG_CONFIG_HOME/ecs-manager or ~/.config/ecs-manager
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdg) {
+		cfgDir = filepath.Join(xdg, "ecs-manager")
+	} else {
+		// Get user's home dir
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 Unable to determine current user's home dir: %s\n\n"), err.Error())
+			os.Exit(1)
+		}
+
+		cfgDir = filepath.Join(home, ".config/ecs-manager")
 	}
 
-	// Configuration dir
-	cfgDir = filepath.Join(home, ".config/ecs-manager")
+	// Default configuration file
+	cfgFile = filepath.Join(cfgDir, "config.yaml")
 
-	viper.SetConfigName("config.yaml")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(cfgDir)
+	// Audit log
+	audit.SetFile(filepath.Join(cfgDir, "audit.log"))
 
-	// Try to read config
-	if err := viper.ReadInConfig(); err != nil {
-		fmt.Printf(p.Error("\U00002717 Unable to read configuration file: %s\n\n"), err.Error())
-		os.Exit(1)
-	}
+	// History of rotations, for estimating how long rotation takes
+	history.SetFile(filepath.Join(cfgDir, "rotation-history.log"))
 
 	// Usage
-	flag.Usage = func() {
-		fmt.Printf("Usage: \n")
-		flag.PrintDefaults()
-	}
+	flag.Usage = printUsage
 
 	// Get arguments
 	flag.BoolVarP(&aPrintVersion, "version", "V", false, "Print version")
+	flag.StringArrayVar(&aConfigFiles, "config", []string{}, "Config file, can be repeated, later files override earlier ones (default $ECS_MANAGER_CONFIG or "+cfgFile+")")
 
+	// Stop parsing at command name, command flags are parsed by command itself
+	flag.CommandLine.SetInterspersed(false)
 	flag.Parse()
 
 }
@@ -82,17 +95,37 @@ func main() {
 
 	if aPrintVersion {
 		fmt.Printf("\n%v %v\n\n", binName, version)
-		fmt.Printf("Config file: %s\n", viper.ConfigFileUsed())
+		fmt.Printf("Config files: %s\n", strings.Join(getConfigFiles(), ", "))
 		fmt.Printf("URL: https://gitlab.com/mzdrale/ecs-manager\n\n")
 		os.Exit(0)
 	}
 
+	// Read config, config validate reports problems with config by itself
+	if flag.Arg(0) != "config" || flag.Arg(1) != "validate" {
+		if err := loadConfig(); err != nil {
+			fmt.Printf(p.Error("\U00002717 Unable to read configuration file: %s\n\n"), err.Error())
+			os.Exit(1)
+		}
+
+		for _, w := range cfg.Warnings {
+			fmt.Fprintf(os.Stderr, p.Warn("\U000026A0 %v\n"), w)
+		}
+	}
+
+	// Run command, if specified, otherwise show menu
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	ctx := context.Background()
+
 	// Main menu
 MainMenu:
 	prompt := promptui.Select{
 		Label: "[ Select action ]",
 		Items: []string{
 			"Clusters",
+			"Export instances of all clusters to file",
 			"Quit",
 		},
 		Size: 30,
@@ -104,6 +137,33 @@ MainMenu:
 		fmt.Printf(p.Error("\U00002717 Main menu failed!\n"))
 	}
 
+	// Export instances of all clusters to file
+	if result == "Export instances of all clusters to file" {
+		format, filename, err := promptExportFile("all-clusters-instances", exportFormats[1:])
+
+		if err != nil {
+			goto MainMenu
+		}
+
+		startTime := time.Now()
+
+		instances, err := getAllClustersInstances()
+
+		if err != nil {
+			fmt.Printf(p.Error("\U00002717 %v\n"), err)
+		} else if len(instances) == 0 {
+			fmt.Println(p.Info("\U00002717 No instances found, nothing to export."))
+		} else if err := exportToFile(filename, format, instances); err != nil {
+			fmt.Printf(p.Error("\U00002717 Couldn't write to file %s: %v\n"), filename, err)
+		} else {
+			fmt.Printf(p.Info("\U00002714 List exported to %s\n"), filename)
+		}
+
+		// Calculate elapsed time and print it
+		printDuration(startTime)
+		goto MainMenu
+	}
+
 	// Clusters menu
 ClustersMenu:
 	if result == "Clusters" {
@@ -165,49 +225,33 @@ ClustersMenu:
 
 		clust := clustersInfo[i]
 
-		testCluster := viper.GetBool(fmt.Sprintf("ecs.%s.test_cluster", clust.ARN))
-		waitForTaskCluster := viper.GetBool(fmt.Sprintf("ecs.%s.wait_for_task", clust.ARN))
-		drainAndTerminateDelay := viper.GetInt(fmt.Sprintf("ecs.%s.drain_and_terminate_delay", clust.ARN))
-		numberOfZeroTasksInstances = 0
-
-		if testCluster {
-			fmt.Printf(p.Red("\n==============================================================\n"))
-			fmt.Printf(p.Red("                          TEST CLUSTER \n"))
-			fmt.Printf(p.Red("______________________________________________________________\n\n"))
-			fmt.Printf(p.Red(" This cluster is marked as test cluster (check config file). \n"))
-			fmt.Printf(p.Red(" It means if you chose to drain instances in this cluster, \n"))
-			fmt.Printf(p.Red(" this tool would not wait for drain to finish, but force stop \n"))
-			fmt.Printf(p.Red(" tasks one by one.\n"))
-			fmt.Printf(p.Red("______________________________________________________________\n\n"))
-		}
-
-		if waitForTaskCluster {
-			numberOfZeroTasksInstances = viper.GetInt(fmt.Sprintf("ecs.%s.number_of_zero_tasks_instances", clust.ARN))
-			fmt.Printf(p.Magenta("\n==============================================================\n"))
-			fmt.Printf(p.Magenta("                     WAIT FOR TASK CLUSTER \n"))
-			fmt.Printf(p.Magenta("______________________________________________________________\n\n"))
-			fmt.Printf(p.Magenta(" This cluster is configured to wait for task (check config file). \n"))
-			fmt.Printf(p.Magenta(" It means if you chose to drain and terminate instances\n"))
-			fmt.Printf(p.Magenta(" in this cluster, this tool would wait for a new instance\n"))
-			fmt.Printf(p.Magenta(" to come up and start at least one task before proceeding\n"))
-			fmt.Printf(p.Magenta(" to the next one.\n"))
-			fmt.Printf(p.Magenta(" Allowed number of instances with 0 tasks running: ", p.Yellow(numberOfZeroTasksInstances)))
-			fmt.Printf(p.Magenta("\n______________________________________________________________\n\n"))
-		}
-
-		// Select cluster action
+		opts := getClusterOptions(clust.ARN)
+		printClusterOptions(opts)
+		printClusterLease(clust)
+
+		reporter := newTerminalReporter()
+		op := ops.New(clust, opts, withNotifications(clust, reporter))
+		op.Pause = reporter.pause
+
+		// Select cluster action, custom actions are added before navigation items
+		clusterMenuItems, clusterCustomActions := addCustomActions(clust.ARN, custom.MenuCluster, []string{
+			"Instances",
+			"Dashboard",
+			"Show cluster settings",
+			"Bulk actions on instances",
+			"Export instances list to file",
+			"Update ECS Agent on all instances in cluster",
+			"Drain and terminate instances, one by one",
+			"Reactivate draining instances",
+			"Go to clusters menu",
+			"Go to main menu",
+			"Quit",
+		}, 8)
+
 		prompt = promptui.Select{
 			Label: "[ Select action ]",
-			Items: []string{
-				"Instances",
-				"Export instances list to file",
-				"Update ECS Agent on all instances in cluster",
-				"Drain and terminate instances, one by one",
-				"Go to clusters menu",
-				"Go to main menu",
-				"Quit",
-			},
-			Size: 30,
+			Items: clusterMenuItems,
+			Size:  30,
 		}
 
 		_, result, err := prompt.Run()
@@ -216,7 +260,19 @@ ClustersMenu:
 			fmt.Printf(p.Error("\U00002717 Cluster menu failed!\n"))
 		}
 
+		// Run custom action
+		if a, ok := clusterCustomActions[result]; ok {
+			runCustomAction(a, clust)
+			goto ClustersMenu
+		}
+
 	InstancesMenu:
+		// Each action is separate operation in audit log, every action in
+		// instances menu comes back here. Override of change windows applies
+		// only to action it was given for.
+		op.ID = ops.NewID()
+		op.Options.OverrideReason = ""
+
 		if result == "Instances" {
 			// Get cluster instances
 			instances, err := aws.GetEcsClusterInstances(clust.ARN)
@@ -275,19 +331,23 @@ ClustersMenu:
 
 				inst := ecsInstancesInfo[i]
 
+				// Custom actions are added before navigation items
+				instanceMenuItems, instanceCustomActions := addCustomActions(clust.ARN, custom.MenuInstance, []string{
+					"Update ECS Agent",
+					"Activate instance",
+					"Drain instance",
+					"Terminate instance",
+					"Drain and terminate instance",
+					"Go to instances menu",
+					"Go to clusters menu",
+					"Go to main menu",
+					"Quit",
+				}, 5)
+
 				prompt = promptui.Select{
 					Label: "[ Select action ]",
-					Items: []string{
-						"Update ECS Agent",
-						"Activate instance",
-						"Drain instance",
-						"Terminate instance",
-						"Drain and terminate instance",
-						"Go to instances menu",
-						"Go to clusters menu",
-						"Go to main menu",
-						"Quit",
-					},
+					Items: instanceMenuItems,
+					Size:  20,
 				}
 
 				_, result, err = prompt.Run()
@@ -297,12 +357,25 @@ ClustersMenu:
 					os.Exit(0)
 				}
 
+				// Run custom action
+				if a, ok := instanceCustomActions[result]; ok {
+					runCustomAction(a, inst)
+					goto InstancesMenu
+				}
+
+				// Don't run actions blocked on cluster, or outside of change windows
+				if action, ok := instanceMenuActions[result]; ok {
+					if !allowAction(op, action) {
+						goto InstancesMenu
+					}
+				}
+
 				// Update ECS Agent
 				if result == "Update ECS Agent" {
 					startTime := time.Now()
 
 					fmt.Printf(p.Info("\U0001F5A5  Update ECS Agent on %s (%s): "), inst.Name, inst.Ec2InstanceID)
-					r, err := aws.UpdateEcsContainerAgent(clust.ARN, inst.Name)
+					r, err := op.UpdateAgent(inst)
 					if err != nil {
 						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't update container agent: %v"), err)
 					} else {
@@ -310,10 +383,7 @@ ClustersMenu:
 					}
 
 					// Calculate elapsed time and print it
-					elapsedTime := time.Since(startTime)
-					fmt.Printf("\n_____________________________________________\n\n")
-					fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-					fmt.Printf("_____________________________________________\n\n")
+					printDuration(startTime)
 					goto InstancesMenu
 
 				}
@@ -323,7 +393,7 @@ ClustersMenu:
 					startTime := time.Now()
 
 					fmt.Printf(p.Info("\U0001F5A5  Activate instance %s (%s): "), inst.Name, inst.Ec2InstanceID)
-					r, err := aws.ActivateEcsContainerInstance(clust.ARN, inst.ARN)
+					r, err := op.Activate(inst)
 					if err != nil {
 						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't activate instance: %v"), err)
 					} else {
@@ -331,10 +401,7 @@ ClustersMenu:
 					}
 
 					// Calculate elapsed time and print it
-					elapsedTime := time.Since(startTime)
-					fmt.Printf("\n_____________________________________________\n\n")
-					fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-					fmt.Printf("_____________________________________________\n\n")
+					printDuration(startTime)
 					goto InstancesMenu
 				}
 
@@ -342,51 +409,52 @@ ClustersMenu:
 				if result == "Drain instance" {
 					startTime := time.Now()
 
-					fmt.Printf(p.Info("\U0001F5A5  Drain instance %s (%s): "), inst.Name, inst.Ec2InstanceID)
-					r, err := aws.DrainEcsContainerInstance(clust.ARN, inst.ARN)
+					err := runWithLease(ctx, clust, ops.ActionDrain, false, func(ctx context.Context) error {
+						if err := op.Begin(ops.ActionDrain); err != nil {
+							return err
+						}
+
+						fmt.Printf(p.Info("\U0001F5A5  Drain instance %s (%s)\n"), inst.Name, inst.Ec2InstanceID)
+						_, err := op.DrainInstance(ctx, inst)
+						reporter.stop()
+						return err
+					})
+
 					if err != nil {
-						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't drain instance: %v"), err)
-					} else {
-						fmt.Println(p.Yellow(r))
+						fmt.Printf(p.Error("\U00002717 Couldn't drain instance: %v\n"), err)
 					}
 
 					// Calculate elapsed time and print it
-					elapsedTime := time.Since(startTime)
-					fmt.Printf("\n_____________________________________________\n\n")
-					fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-					fmt.Printf("_____________________________________________\n\n")
+					printDuration(startTime)
 					goto InstancesMenu
 
 				}
 
 				// Terminate instance
 				if result == "Terminate instance" {
-					prompt := promptui.Prompt{
-						Label:     "Are you sure you want to do this",
-						IsConfirm: true,
-					}
-
-					result, err := prompt.Run()
-
-					if err != nil || result != "y" {
+					if !confirmDestructive(clust, op.Options, "Are you sure you want to do this", false, "") {
 						goto InstancesMenu
 					}
 
 					startTime := time.Now()
 
-					fmt.Printf(p.Info("\U0001F5A5  Terminate instance %s (%s): "), inst.Name, inst.Ec2InstanceID)
-					r, err := aws.TerminateEc2Instance(inst.Ec2InstanceID)
+					err = runWithLease(ctx, clust, ops.ActionTerminate, false, func(ctx context.Context) error {
+						if err := op.Begin(ops.ActionTerminate); err != nil {
+							return err
+						}
+
+						fmt.Printf(p.Info("\U0001F5A5  Terminate instance %s (%s)\n"), inst.Name, inst.Ec2InstanceID)
+						_, err := op.TerminateInstance(ctx, inst)
+						reporter.stop()
+						return err
+					})
+
 					if err != nil {
-						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't terminate instance: %v"), err)
-					} else {
-						fmt.Println(p.Yellow(r))
+						fmt.Printf(p.Error("\U00002717 Couldn't terminate instance: %v\n"), err)
 					}
 
 					// Calculate elapsed time and print it
-					elapsedTime := time.Since(startTime)
-					fmt.Printf("\n_____________________________________________\n\n")
-					fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-					fmt.Printf("_____________________________________________\n\n")
+					printDuration(startTime)
 
 					// Sleep few seconds before going back to instances list
 					time.Sleep(3 * time.Second)
@@ -395,97 +463,30 @@ ClustersMenu:
 
 				// Drain and terminate instance
 				if result == "Drain and terminate instance" {
-					prompt := promptui.Prompt{
-						Label:     "Are you sure you want to do this",
-						IsConfirm: true,
-					}
-
-					result, err := prompt.Run()
-
-					if err != nil || result != "y" {
+					if !confirmDestructive(clust, op.Options, "Are you sure you want to do this", false, "") {
 						goto InstancesMenu
 					}
 
 					startTime := time.Now()
 
-					// Drain instance
-					fmt.Printf(p.Info("\U0001F6B0 Drain instance %s (%s): "), inst.Name, inst.Ec2InstanceID)
-					r, err := aws.DrainEcsContainerInstance(clust.ARN, inst.Name)
-					if err != nil {
-						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't drain container instance: %v\n"), err)
-						goto InstancesMenu
-					} else {
-						fmt.Println(p.Yellow(r))
-					}
-
-					// Get instance info
-					r1, err := aws.GetEcsClusterInstancesInfo(clust.ARN, []string{inst.Name})
-					if err != nil {
-						fmt.Printf(p.Error("\n   \U00002717 Couldn't get instance info: %v\n"), err)
-					}
-					inst := r1[0]
-
-					loop := true
-					actionFailedCnt := 0
-					for loop {
-						sleepTime := 10 * time.Second
-
-						// Get instance task list
-						tasks, err := aws.GetEcsInstanceTasks(clust.ARN, inst.Name)
-
-						if err != nil {
-							fmt.Printf(p.Error("\n   \U00002717 Couldn't get list of tasks: %v\n"), err)
+					err = runWithLease(ctx, clust, ops.ActionDrainAndTerminate, false, func(ctx context.Context) error {
+						if err := op.Begin(ops.ActionDrainAndTerminate); err != nil {
+							return err
 						}
 
-						// Number of tasks
-						runningTasksCount := len(tasks)
+						fmt.Printf(p.Info("\U0001F5A5  Drain and terminate instance %s (%s)\n"), inst.Name, inst.Ec2InstanceID)
+						_, err := op.DrainAndTerminate(ctx, inst)
+						reporter.stop()
+						return err
+					})
 
-						// If task count reached 0, stop the loop
-						if runningTasksCount == 0 {
-							loop = false
-						}
-
-						// If it's test cluster, stop tasks, don't wait for drain to finish
-						if testCluster && runningTasksCount > 0 {
-							r, err = aws.StopEcsTask(clust.ARN, tasks[0])
-							fmt.Printf(p.Info("   \U0000276F Stop task %s: "), tasks[0])
-							if err != nil {
-								fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't stop the task: %v\n"), err)
-								actionFailedCnt++
-							} else {
-								fmt.Println(p.Yellow(r))
-							}
-						} else {
-							fmt.Printf("\r   \U0000276F %s %s (need %s)  ", p.Grey("Running tasks:"), p.Green(runningTasksCount), p.Yellow("0"))
-						}
-
-						// If action failed so many times, give up
-						if actionFailedCnt > 5 {
-							fmt.Print(p.Error("    \U00002937 Failed too many times, giving up!\n\n"))
-							goto InstancesMenu
-						}
-
-						if loop && r != "FAILED" {
-							time.Sleep(sleepTime)
-						}
-					}
-					fmt.Println()
-
-					fmt.Printf(p.Info("   \U0000276F Terminate instance: "))
-
-					// Terminate instance
-					r, err = aws.TerminateEc2Instance(inst.Ec2InstanceID)
 					if err != nil {
-						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't terminate instance: %v"), err)
-					} else {
-						fmt.Println(p.Yellow(r))
+						fmt.Printf(p.Error("\U00002717 Couldn't drain and terminate instance: %v\n"), err)
+						offerReactivation(op, startTime)
 					}
 
 					// Calculate elapsed time and print it
-					elapsedTime := time.Since(startTime)
-					fmt.Printf("\n_____________________________________________\n\n")
-					fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-					fmt.Printf("_____________________________________________\n\n")
+					printDuration(startTime)
 
 					// Sleep few seconds before going back to instances list
 					time.Sleep(3 * time.Second)
@@ -515,56 +516,54 @@ ClustersMenu:
 
 		}
 
-		// Export instances list to file
-		if result == "Export instances list to file" {
-			startTime := time.Now()
+		// Show dashboard, refreshed until user presses enter
+		if result == "Dashboard" {
+			showDashboard(ctx, clust)
+			goto ClustersMenu
+		}
 
-			// Get cluster instances
-			instances, err := aws.GetEcsClusterInstances(clust.ARN)
+		// Show effective cluster settings and where they come from
+		if result == "Show cluster settings" {
+			printClusterSettings(clust)
+			goto ClustersMenu
+		}
 
-			if err != nil {
-				fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n", clust.Name, err))
-			}
+		// Run action on multiple instances
+		if result == "Bulk actions on instances" {
+			startTime := time.Now()
 
-			if len(instances) > 0 {
+			runBulkAction(ctx, op, reporter)
 
-				ecsInstancesInfo, err = aws.GetEcsClusterInstancesInfo(clust.ARN, instances)
-				if err != nil {
-					fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
-				}
+			// Calculate elapsed time and print it
+			printDuration(startTime)
+			goto ClustersMenu
+		}
 
-				// File name
-				filename := filepath.Join(cfgDir, fmt.Sprintf("%s-instances.list", clust.Name))
+		// Export instances list to file
+		if result == "Export instances list to file" {
+			format, filename, err := promptExportFile(fmt.Sprintf("%s-instances", clust.Name), exportFormats)
 
-				// Create file and open for writing
-				f, err := os.Create(filename)
-				if err != nil {
-					fmt.Printf(p.Error("\U00002717 Couldn't create file %s: %v\n"), filename, err)
-				}
+			if err != nil {
+				goto ClustersMenu
+			}
 
-				// Iterate through instances and write to file
-				for _, inst := range ecsInstancesInfo {
-					line := fmt.Sprintf("%s (EC2:%s, AMI:%s)\n", inst.Name, inst.Ec2InstanceID, inst.AMI)
-					_, err := f.WriteString(line)
-					if err != nil {
-						fmt.Printf(p.Error("\U00002717 Couldn't write to file %s: %v\n"), filename, err)
-						f.Close()
-						goto ClustersMenu
-					}
-				}
-				f.Close()
+			startTime := time.Now()
 
-				fmt.Printf(p.Info("\U00002714 List exported to %s\n"), filename)
+			// Get cluster instances
+			instances, err := op.Instances()
 
-			} else {
+			if err != nil {
+				fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+			} else if len(instances) == 0 {
 				fmt.Println(p.Info("\U00002717 No instances in cluster, nothing to export."))
+			} else if err := exportToFile(filename, format, instances); err != nil {
+				fmt.Printf(p.Error("\U00002717 Couldn't write to file %s: %v\n"), filename, err)
+			} else {
+				fmt.Printf(p.Info("\U00002714 List exported to %s\n"), filename)
 			}
 
 			// Calculate elapsed time and print it
-			elapsedTime := time.Since(startTime)
-			fmt.Printf("\n_____________________________________________\n\n")
-			fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-			fmt.Printf("_____________________________________________\n\n")
+			printDuration(startTime)
 			goto ClustersMenu
 		}
 
@@ -572,81 +571,73 @@ ClustersMenu:
 		if result == "Update ECS Agent on all instances in cluster" {
 			startTime := time.Now()
 
-			// Get cluster instances
-			instances, err := aws.GetEcsClusterInstances(clust.ARN)
+			err := op.UpdateAgents(ctx)
+			reporter.stop()
+			printOperationError(err)
 
-			if err != nil {
-				fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
-			}
+			// Calculate elapsed time and print it
+			printDuration(startTime)
 
-			if len(instances) > 0 {
-				ecsInstancesInfo, err = aws.GetEcsClusterInstancesInfo(clust.ARN, instances)
-				if err != nil {
-					fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
-				}
+			goto ClustersMenu
+		}
 
-				// Iterate through instance list and update container agent
-				for i, inst := range ecsInstancesInfo {
-					fmt.Printf(p.Info("\U0001F5A5  Update agent on %s (%s) [%02d/%02d]: "), inst.Name, inst.Ec2InstanceID, i+1, len(ecsInstancesInfo))
-					r, err := aws.UpdateEcsContainerAgent(clust.ARN, inst.Name)
-					if err != nil {
-						fmt.Printf(p.Error("FAILED\n    \U00002937 \U00002717 Couldn't update container agent: %v\n"), err)
-					} else {
-						fmt.Println(p.Yellow(r))
-					}
+		// Select DRAINING instances and activate them
+		if result == "Reactivate draining instances" {
+			startTime := time.Now()
 
-					// Let's wait a few seconds before proceeding to next instance
-					if r == "PENDING" && i < len(ecsInstancesInfo)-1 {
-						time.Sleep(10 * time.Second)
-					}
-				}
-			} else {
-				fmt.Println(p.Info("\U00002717 No instances in cluster, nothing to do."))
-			}
+			reactivateDraining(op)
 
 			// Calculate elapsed time and print it
-			elapsedTime := time.Since(startTime)
-			fmt.Printf("\n_____________________________________________\n\n")
-			fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-			fmt.Printf("_____________________________________________\n\n")
-
+			printDuration(startTime)
 			goto ClustersMenu
 		}
 
 		// Drain and terminate instances, one by one
 		if result == "Drain and terminate instances, one by one" {
-
-			prompt := promptui.Prompt{
-				Label:     "Are you sure you want to do this",
-				IsConfirm: true,
+			if !allowAction(op, ops.ActionRotate) {
+				goto ClustersMenu
 			}
 
-			result, err := prompt.Run()
-
-			if err != nil || result != "y" {
+			// Excluded instances are not known yet, estimate is for all of them
+			if !confirmDestructive(clust, op.Options, "Are you sure you want to do this"+rotationEstimate(clust, int(clust.RegisteredInstancesCount)), false, "") {
 				goto ClustersMenu
 			}
 
-			startTime := time.Now()
-
 			// Get cluster instances
-			instances, err := aws.GetEcsClusterInstances(clust.ARN)
+			instances, err := op.Instances()
 
 			if err != nil {
 				fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+				goto ClustersMenu
 			}
 
 			// Get list of excluded instances
-			excludeFilename := filepath.Join(cfgDir, fmt.Sprintf("%s-instances.exclude", clust.Name))
-			excludedInstances, err := common.ReadExcludedInstancesList(excludeFilename)
+			excludeFilename := getExcludeFilename(clust)
+			rules, invalidRulesCount, err := readExcludeRules(excludeFilename)
 
 			if err != nil {
 				fmt.Printf(p.Error("\U00002717 Couldn't get list of excluded instances from %s: %v\n"), excludeFilename, err)
+				goto ClustersMenu
+			}
+
+			// Don't risk terminating instances which were supposed to be excluded,
+			// invalid lines are listed above
+			if invalidRulesCount > 0 {
+				fmt.Printf(p.Error("\U00002717 Fix invalid exclusion rules in %s first\n"), excludeFilename)
+				goto ClustersMenu
+			}
+
+			excludedInstances, err := getExcludedInstances(rules, instances)
+
+			if err != nil {
+				fmt.Printf(p.Error("\U00002717 Couldn't get list of excluded instances: %v\n"), err)
+				goto ClustersMenu
 			}
 
 			// If there are instances in excluded list, raise a warning
 			if len(excludedInstances) > 0 {
-				fmt.Printf(p.Warn("\U000026A0 Exclude list is not empty: %s\n"), strings.Join(excludedInstances, ", "))
+				fmt.Printf(p.Warn("\U000026A0 Exclude list is not empty:\n"))
+				printExcludedInstances(excludedInstances)
 
 				prompt := promptui.Prompt{
 					Label:     "Do you want to exclude these instances",
@@ -656,220 +647,432 @@ ClustersMenu:
 				result, err := prompt.Run()
 
 				if err != nil || result != "y" {
-					excludedInstances = []string{}
+					excludedInstances = []excludedInstance{}
 				}
 
 			}
 
-			// Get cluster info
-			r, err := aws.GetEcsClustersInfo([]string{clust.ARN})
-			if err != nil {
-				fmt.Printf(p.Error("\U00002717 Couldn't get cluster info: %v\n"), clust.Name, err)
-			}
+			op.Options.Excluded = excludedInstanceIDs(excludedInstances)
+			summary, _, err := rotateCluster(op, reporter, false)
 
-			registeredInstancesCount := r[0].RegisteredInstancesCount
+			if err != ops.ErrNoInstances && confirm("Do you want to save rotation report", false) {
+				name := fmt.Sprintf("%s-rotation-%s", clust.Name, summary.started.Format("20060102-150405"))
 
-			// Iterate over instances
-			if len(instances) > 0 {
-				ecsInstancesInfo, err = aws.GetEcsClusterInstancesInfo(clust.ARN, instances)
-				if err != nil {
-					fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), clust.Name, err)
+				// Report exists only in memory, so another file can be chosen if it can't be written
+				for {
+					format, filename, err := promptExportFile(name, reportFormats)
+
+					if err != nil {
+						fmt.Println(p.Warn("\U000026A0 Rotation report not saved"))
+						break
+					}
+
+					if err := saveRotationReport(summary, filename, format); err == nil {
+						break
+					}
+
+					if !confirm("Do you want to save rotation report to another file", false) {
+						fmt.Println(p.Warn("\U000026A0 Rotation report not saved"))
+						break
+					}
 				}
+			}
 
-				s := spinner.New(spinner.CharSets[11], 200*time.Millisecond)
+			goto ClustersMenu
+		}
 
-				// Iterate through instance list and drain and terminate instances
-				for i, inst := range ecsInstancesInfo {
-					fmt.Printf(p.Info("\U0001F5A5  [%02d/%02d] Instance %s (%s)\n"), i+1, len(ecsInstancesInfo), inst.Name, inst.Ec2InstanceID)
+		// Jump to clusters menu
+		if result == "Go to clusters menu" {
+			goto ClustersMenu
+		}
 
-					if waitForTaskCluster {
-						loop := true
+		// Jump to main menu
+		if result == "Go to main menu" {
+			goto MainMenu
+		}
 
-						s.Prefix = fmt.Sprintf("   \U0000276F %s ", p.Grey("Waiting for instances to get in active state and start task(s)"))
-						s.Start()
+		// Quit
+		if result == "Quit" {
+			os.Exit(0)
+		}
+	}
 
-						for loop {
-							sleepTime := 10 * time.Second
+	if result == "Go to main menu" {
+		goto MainMenu
+	}
 
-							if aws.IsEcsClusterReady(clust.ARN, true, numberOfZeroTasksInstances) {
-								s.Stop()
-								fmt.Printf("   \U0000276F %s \n", p.Grey("Waiting for instances to get in active state and start task(s)"))
-								fmt.Printf("   \U0000276F %s \n", p.Grey("All instances are active and running at least one task"))
-								loop = false
-							}
+	if result == "Quit" {
+		os.Exit(0)
+	}
 
-							if loop {
-								time.Sleep(sleepTime)
-							}
-						}
-						s.Stop()
-					}
+}
 
-					fmt.Printf(p.Info("   \U0000276F Drain instance: "))
+// getConfigFiles - get config files to load, in order: files given with
+// --config, files listed in ECS_MANAGER_CONFIG, or default config file if it
+// exists. Without config file, built-in defaults are used for all clusters.
+func getConfigFiles() []string {
+	if len(aConfigFiles) > 0 {
+		return aConfigFiles
+	}
 
-					// Check if instance is excluded
-					if common.ElementInSlice(inst.Name, excludedInstances) {
-						fmt.Println(p.Green("EXCLUDED"))
-						continue
-					}
+	if env := os.Getenv("ECS_MANAGER_CONFIG"); env != "" {
+		files := []string{}
+		for _, f := range filepath.SplitList(env) {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+		return files
+	}
 
-					// Drain instance
-					r, err := aws.DrainEcsContainerInstance(clust.ARN, inst.Name)
-					if err != nil {
-						fmt.Printf(p.Error("FAILED\n      \U00002937 \U00002717 Couldn't drain container instance: %v\n"), err)
-						continue
-					} else {
-						fmt.Println(p.Yellow(r))
-					}
+	if _, err := os.Stat(cfgFile); errors.Is(err, fs.ErrNotExist) {
+		return []string{}
+	}
 
-					// Get instance info
-					r1, err := aws.GetEcsClusterInstancesInfo(clust.ARN, []string{inst.Name})
-					if err != nil {
-						fmt.Printf(p.Error("\n   \U00002717 Couldn't get instance info: %v\n"), err)
-					}
-					inst := r1[0]
+	return []string{cfgFile}
+}
 
-					loop := true
-					for loop {
-						sleepTime := 10 * time.Second
+// Actions run from instance menu
+var instanceMenuActions = map[string]string{
+	"Update ECS Agent":             ops.ActionUpdateAgent,
+	"Activate instance":            ops.ActionActivate,
+	"Drain instance":               ops.ActionDrain,
+	"Terminate instance":           ops.ActionTerminate,
+	"Drain and terminate instance": ops.ActionDrainAndTerminate,
+}
 
-						// Get instance task list
-						tasks, err := aws.GetEcsInstanceTasks(clust.ARN, inst.Name)
+// addCustomActions - add custom actions configured for cluster to menu items
+// at given index. Actions named like existing items are skipped.
+func addCustomActions(arn string, menu string, items []string, at int) ([]string, map[string]custom.Action) {
+	added := []string{}
+	actions := map[string]custom.Action{}
 
-						if err != nil {
-							fmt.Printf(p.Error("\n   \U00002717 Couldn't get list of tasks: %v\n"), err)
-						}
+	for _, a := range custom.ForMenu(cfg.Cluster(arn).CustomActions, menu) {
+		if common.ElementInSlice(a.Name, items) || common.ElementInSlice(a.Name, added) {
+			fmt.Printf(p.Warn("\U000026A0 Custom action %q is skipped, menu already has entry with that name\n"), a.Name)
+			continue
+		}
 
-						// Number of tasks
-						runningTasksCount := len(tasks)
-
-						// If it's test cluster, stop tasks, don't wait for drain to finish
-						if testCluster && runningTasksCount > 0 {
-							r, err = aws.StopEcsTask(clust.ARN, tasks[0])
-							fmt.Printf(p.Info("   \U0000276F Stop task %s: "), tasks[0])
-
-							if err != nil {
-								fmt.Printf(p.Error("FAILED\n      \U00002937 \U00002717 Couldn't stop the task: %v\n"), err)
-							} else {
-								fmt.Println(p.Yellow(r))
-							}
-						} else {
-							fmt.Printf("\r   \U0000276F %s %s (need %s)  ", p.Grey("Running tasks:"), p.Green(runningTasksCount), p.Yellow("0"))
-						}
+		added = append(added, a.Name)
+		actions[a.Name] = a
+	}
 
-						// If task count reached 0, stop the loop
-						if runningTasksCount == 0 {
-							loop = false
-						}
+	r := append([]string{}, items[:at]...)
+	r = append(r, added...)
+	r = append(r, items[at:]...)
 
-						if loop {
-							time.Sleep(sleepTime)
-						}
-					}
-					fmt.Println()
+	return r, actions
+}
 
-					fmt.Printf(p.Info("   \U0000276F Terminate instance: "))
+// runCustomAction - render command of custom action against instance or
+// cluster and run it
+func runCustomAction(a custom.Action, data interface{}) {
+	command, err := a.Render(data)
 
-					// Terminate instance
-					r, err = aws.TerminateEc2Instance(inst.Ec2InstanceID)
-					if err != nil {
-						fmt.Printf(p.Error("FAILED\n      \U00002937 \U00002717 Couldn't terminate instance: %v\n"), err)
-					} else {
-						fmt.Println(p.Yellow(r))
-					}
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't render command of %s: %v\n"), a.Name, err)
+		return
+	}
 
-					s.Prefix = fmt.Sprintf("   \U0000276F %s ", p.Grey("Waiting for instance to shut down"))
-					s.Start()
+	fmt.Printf(p.Info("\U0000276F %s\n"), command)
 
-					// Wait for number of registered instances to decrease by 1
-					loop = true
-					for loop {
-						sleepTime := 10 * time.Second
+	if a.Confirm && !confirm("Do you want to run this command", false) {
+		return
+	}
 
-						if aws.IsEc2InstanceTerminated(inst.Ec2InstanceID) {
-							s.Stop()
-							fmt.Printf("   \U0000276F %s \n", p.Grey("Waiting for instance to shut down"))
-							loop = false
-						}
+	startTime := time.Now()
 
-						if loop {
-							time.Sleep(sleepTime)
-						}
-					}
-					fmt.Printf("   \U0000276F %s\n", p.Grey("Instance terminated, waiting for a new one"))
-					s.Stop()
+	if err := custom.Run(command); err != nil {
+		fmt.Printf(p.Error("\U00002717 %s failed: %v\n"), a.Name, err)
+	}
 
-					// Wait for number of registered instances to go back to initial value
-					loop = true
-					for loop {
-						sleepTime := 10 * time.Second
+	// Calculate elapsed time and print it
+	printDuration(startTime)
+}
 
-						// Get cluster info
-						r, err := aws.GetEcsClustersInfo([]string{clust.ARN})
+// loadConfig - read, validate and merge config files
+func loadConfig() error {
+	c, err := config.LoadFiles(getConfigFiles())
 
-						if err != nil {
-							fmt.Printf(p.Error("\n   \U00002717 Couldn't get cluster info: %v\n"), err)
-						}
+	if err != nil {
+		return err
+	}
 
-						fmt.Printf("\r   \U0000276F %s %s (need %s)  ", p.Grey("Registered instances count:"), p.Green(r[0].RegisteredInstancesCount), p.Yellow(registeredInstancesCount))
+	cfg = c
 
-						// If registered instances count is back to initial value (all instances in cluster), stop the loop
-						if r[0].RegisteredInstancesCount >= registeredInstancesCount {
-							loop = false
-						}
+	return nil
+}
 
-						if loop {
-							time.Sleep(sleepTime)
-						}
-					}
-					fmt.Println()
-
-					// Wait before proceeding with the next instance
-					if drainAndTerminateDelay > 0 && i < len(ecsInstancesInfo) {
-						s.Prefix = fmt.Sprintf("   \U0000276F %s %s %s ", p.Grey("Waiting"), p.White(drainAndTerminateDelay), p.Grey("seconds"))
-						s.Start()
-						time.Sleep(time.Duration(drainAndTerminateDelay) * time.Second)
-						s.Stop()
-					}
-					fmt.Println()
+// getClusterOptions - get cluster specific settings from config file
+func getClusterOptions(arn string) ops.Options {
+	c := cfg.Cluster(arn)
+
+	opts := ops.Options{
+		ForceStopTasks:         c.TestCluster,
+		WaitForTask:            c.WaitForTask,
+		DrainAndTerminateDelay: time.Duration(c.DrainAndTerminateDelay) * time.Second,
+		StopDaemonTasks:        c.StopDaemonTasks,
+		Protected:              c.Protected,
+		BlockedActions:         c.BlockedActions,
+		ChangeWindows:          c.ChangeWindows,
+		Freeze:                 c.Freeze,
+		WaitTimeout:            time.Duration(c.WaitTimeout) * time.Second,
+		Hooks:                  c.Hooks,
+	}
 
-				}
+	if opts.WaitForTask {
+		opts.NumberOfZeroTasksInstances = c.NumberOfZeroTasksInstances
+	}
 
-				// Calculate elapsed time and print it
-				elapsedTime := time.Since(startTime)
-				fmt.Printf("\n_____________________________________________\n\n")
-				fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
-				fmt.Printf("_____________________________________________\n\n")
+	if c.EventsQueue != "" {
+		opts.Events = events.NewSQS(c.EventsQueue)
+	}
 
-			} else {
-				fmt.Println(p.Info("\U00002717 No instances in cluster, nothing to do."))
-			}
+	return opts
+}
 
-			goto ClustersMenu
+// getConfiguredClusters - get ARNs of existing clusters which have settings in config file
+func getConfiguredClusters() ([]string, error) {
+	configured := []string{}
+
+	clusters, err := aws.GetEcsClusters()
+
+	if err != nil {
+		return configured, err
+	}
+
+	for _, arn := range clusters {
+		if cfg.IsConfigured(arn) {
+			configured = append(configured, arn)
 		}
+	}
 
-		// Jump to clusters menu
-		if result == "Go to clusters menu" {
-			goto ClustersMenu
+	return configured, nil
+}
+
+// printClusterOptions - print warnings about cluster specific settings
+func printClusterOptions(opts ops.Options) {
+	if opts.ForceStopTasks {
+		fmt.Printf(p.Red("\n==============================================================\n"))
+		fmt.Printf(p.Red("                          TEST CLUSTER \n"))
+		fmt.Printf(p.Red("______________________________________________________________\n\n"))
+		fmt.Printf(p.Red(" This cluster is marked as test cluster (check config file). \n"))
+		fmt.Printf(p.Red(" It means if you chose to drain instances in this cluster, \n"))
+		fmt.Printf(p.Red(" this tool would not wait for drain to finish, but force stop \n"))
+		fmt.Printf(p.Red(" tasks one by one.\n"))
+		fmt.Printf(p.Red("______________________________________________________________\n\n"))
+	}
+
+	if opts.WaitForTask {
+		fmt.Printf(p.Magenta("\n==============================================================\n"))
+		fmt.Printf(p.Magenta("                     WAIT FOR TASK CLUSTER \n"))
+		fmt.Printf(p.Magenta("______________________________________________________________\n\n"))
+		fmt.Printf(p.Magenta(" This cluster is configured to wait for task (check config file). \n"))
+		fmt.Printf(p.Magenta(" It means if you chose to drain and terminate instances\n"))
+		fmt.Printf(p.Magenta(" in this cluster, this tool would wait for a new instance\n"))
+		fmt.Printf(p.Magenta(" to come up and start at least one task before proceeding\n"))
+		fmt.Printf(p.Magenta(" to the next one.\n"))
+		fmt.Printf(p.Magenta(" Allowed number of instances with 0 tasks running: ", p.Yellow(opts.NumberOfZeroTasksInstances)))
+		fmt.Printf(p.Magenta("\n______________________________________________________________\n\n"))
+	}
+	if opts.Protected {
+		fmt.Printf(p.Warn("\U0001F512 Protected cluster, cluster name has to be typed to confirm terminating instances\n"))
+	}
+
+	if len(opts.BlockedActions) > 0 {
+		fmt.Printf(p.Warn("\U000026A0 Actions blocked on this cluster: %s\n"), strings.Join(opts.BlockedActions, ", "))
+	}
+
+	if err := window.Check(opts.ChangeWindows, opts.Freeze, time.Now()); err != nil {
+		fmt.Printf(p.Warn("\U000026A0 %v, instances can't be drained or terminated without override\n"), err)
+	}
+
+	if !opts.Hooks.IsEmpty() {
+		fmt.Printf(p.Info("\U0000276F Hooks: %s\n"), opts.Hooks)
+	}
+
+	if opts.Events != nil {
+		fmt.Printf(p.Info("\U0000276F Waits wake up on ECS events from %s\n"), opts.Events)
+	}
+}
+
+// printClusterSettings - print effective cluster settings, merged from
+// defaults and all matching entries in config file, and source of each one
+func printClusterSettings(clust aws.EcsCluster) {
+	_, settings := cfg.Effective(clust.ARN)
+
+	fmt.Printf(p.Info("\U0001F5A5  Settings of cluster %s:\n"), clust.Name)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+
+	for _, s := range settings {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", s.Key, s.Value, s.Source)
+	}
+
+	tw.Flush()
+
+	matching := cfg.Matching(clust.ARN)
+
+	if len(matching) == 0 {
+		fmt.Println(p.Grey("   No entries in config file match this cluster, built-in defaults are used"))
+		return
+	}
+
+	fmt.Println(p.Grey("   Matching config entries, later ones take precedence:"))
+	for _, e := range matching {
+		fmt.Printf(p.Grey("   \U00002937 %s\n"), e.Source())
+	}
+}
+
+// getExcludeFilename - get path of file with list of instances excluded from draining and terminating
+func getExcludeFilename(clust aws.EcsCluster) string {
+	return filepath.Join(cfgDir, fmt.Sprintf("%s-instances.exclude", clust.Name))
+}
+
+// excludedInstance holds information about excluded instance and rule which excludes it
+type excludedInstance struct {
+	Instance aws.EcsInstance
+	Rule     exclude.Rule
+}
+
+// readExcludeRules - read exclusion rules from file and print lines which couldn't
+// be parsed, returns rules and number of invalid lines
+func readExcludeRules(filename string) (exclude.Rules, int, error) {
+	rules, parseErrors, err := exclude.ReadFile(filename)
+
+	if err != nil {
+		return rules, 0, err
+	}
+
+	for _, e := range parseErrors {
+		fmt.Printf(p.Warn("\U000026A0 Invalid exclusion rule in %s, %v\n"), filename, e)
+	}
+
+	return rules, len(parseErrors), nil
+}
+
+// getExcludedInstances - find instances excluded by rules, expired rules are
+// printed and ignored
+func getExcludedInstances(rules exclude.Rules, instances []aws.EcsInstance) ([]excludedInstance, error) {
+	excluded := []excludedInstance{}
+
+	active, expired := rules.Split(time.Now())
+
+	for _, r := range expired {
+		fmt.Printf(p.Warn("\U000026A0 Exclusion rule %q expired on %s, ignoring it\n"), r.Text, r.Expires.Local().Format(time.RFC1123))
+	}
+
+	// Get EC2 tags only if there are rules which need them
+	tags := map[string]map[string]string{}
+
+	if active.NeedsTags() {
+		ids := []string{}
+		for _, inst := range instances {
+			ids = append(ids, inst.Ec2InstanceID)
 		}
 
-		// Jump to main menu
-		if result == "Go to main menu" {
-			goto MainMenu
+		var err error
+		tags, err = aws.GetEc2InstancesTags(ids)
+
+		if err != nil {
+			return excluded, fmt.Errorf("Couldn't get EC2 instances tags: %v", err)
 		}
+	}
 
-		// Quit
-		if result == "Quit" {
-			os.Exit(0)
+	for _, inst := range instances {
+		if r, ok := active.Match(inst, tags[inst.Ec2InstanceID]); ok {
+			excluded = append(excluded, excludedInstance{Instance: inst, Rule: r})
 		}
 	}
 
-	if result == "Go to main menu" {
-		goto MainMenu
+	return excluded, nil
+}
+
+// getExcludedInstanceIDs - get container instance IDs excluded by rules in
+// cluster exclude file, invalid rules are treated as error
+func getExcludedInstanceIDs(clust aws.EcsCluster, instances []aws.EcsInstance) ([]string, error) {
+	filename := getExcludeFilename(clust)
+	rules, parseErrors, err := exclude.ReadFile(filename)
+
+	if err != nil {
+		return []string{}, err
 	}
 
-	if result == "Quit" {
-		os.Exit(0)
+	if len(parseErrors) > 0 {
+		return []string{}, fmt.Errorf("Invalid exclusion rule in %s, %v", filename, parseErrors[0])
+	}
+
+	excluded, err := getExcludedInstances(rules, instances)
+
+	return excludedInstanceIDs(excluded), err
+}
+
+// printExcludedInstances - print excluded instances and rules which exclude them
+func printExcludedInstances(excluded []excludedInstance) {
+	for _, e := range excluded {
+		fmt.Printf("   \U0000276F %s (%s) %s\n", e.Instance.Name, e.Instance.Ec2InstanceID, p.Grey(e.Rule.Text))
+	}
+}
+
+// excludedInstanceIDs - get container instance IDs of excluded instances
+func excludedInstanceIDs(excluded []excludedInstance) []string {
+	ids := []string{}
+	for _, e := range excluded {
+		ids = append(ids, e.Instance.Name)
+	}
+	return ids
+}
+
+// printOperationError - print error returned by operation
+func printOperationError(err error) {
+	if err == ops.ErrNoInstances {
+		fmt.Println(p.Info("\U00002717 No instances in cluster, nothing to do."))
+	} else if err == ops.ErrStopped {
+		fmt.Printf(p.Warn("\U000026A0 %v\n"), err)
+	} else if err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
 	}
+}
+
+// allowAction - check if action can be run on cluster. Outside of change
+// windows, user is asked for reason to override them. Reason is asked for
+// each action, reason given for earlier action is dropped.
+func allowAction(op *ops.Operation, action string) bool {
+	op.Options.OverrideReason = ""
+
+	err := op.Allowed(action)
+
+	var closed window.ClosedError
+	if errors.As(err, &closed) && common.IsTerminal(os.Stdin) {
+		fmt.Printf(p.Warn("\U000026A0 %v\n"), err)
+
+		prompt := promptui.Prompt{
+			Label: "Reason for overriding change window, it's written to audit log (leave empty to abort)",
+		}
+
+		reason, err := prompt.Run()
+
+		if err != nil || strings.TrimSpace(reason) == "" {
+			return false
+		}
+
+		op.Options.OverrideReason = strings.TrimSpace(reason)
+		return true
+	}
+
+	if err != nil {
+		printOperationError(err)
+		return false
+	}
+
+	return true
+}
 
+// printDuration - calculate elapsed time and print it
+func printDuration(startTime time.Time) {
+	elapsedTime := time.Since(startTime)
+	fmt.Printf("\n_____________________________________________\n\n")
+	fmt.Printf("   %s %s\n", p.Grey("Duration:"), common.FormatDuration(elapsedTime))
+	fmt.Printf("_____________________________________________\n\n")
 }
@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+)
+
+// Prefix of all metric names
+const namespace = "ecs_manager"
+
+// Content type of Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric holds description of single metric
+type metric struct {
+	name string
+	help string
+}
+
+// Cluster metrics
+var (
+	clusterUp                  = metric{"cluster_up", "Whether cluster and its instances were fetched successfully in last poll"}
+	clusterRegisteredInstances = metric{"cluster_registered_instances", "Number of container instances registered in cluster"}
+	clusterRunningTasks        = metric{"cluster_running_tasks", "Number of tasks in RUNNING state in cluster"}
+	clusterPendingTasks        = metric{"cluster_pending_tasks", "Number of tasks in PENDING state in cluster"}
+	clusterActiveServices      = metric{"cluster_active_services", "Number of services in ACTIVE state in cluster"}
+)
+
+// Instance metrics
+var (
+	instanceInfo            = metric{"instance_info", "Information about container instance, value is always 1"}
+	instanceRunningTasks    = metric{"instance_running_tasks", "Number of tasks in RUNNING state on container instance"}
+	instancePendingTasks    = metric{"instance_pending_tasks", "Number of tasks in PENDING state on container instance"}
+	instanceRemainingCPU    = metric{"instance_remaining_cpu", "CPU units remaining on container instance"}
+	instanceRemainingMemory = metric{"instance_remaining_memory", "Memory (MiB) remaining on container instance"}
+	instanceRegisteredCPU   = metric{"instance_registered_cpu", "CPU units registered by container instance"}
+	instanceRegisteredMem   = metric{"instance_registered_memory", "Memory (MiB) registered by container instance"}
+)
+
+// Exporter metrics
+var (
+	lastPoll         = metric{"last_poll_timestamp_seconds", "Time of last poll as Unix timestamp"}
+	lastPollDuration = metric{"last_poll_duration_seconds", "Duration of last poll in seconds"}
+)
+
+// cluster holds information about cluster and its instances collected in one poll
+type cluster struct {
+	info      aws.EcsCluster
+	instances []aws.EcsInstance
+	up        bool
+}
+
+// Exporter polls ECS clusters on interval and serves collected data in
+// Prometheus text exposition format
+type Exporter struct {
+	// Cluster names or ARNs, all clusters are polled if empty
+	Clusters []string
+	// Interval between two polls
+	Interval time.Duration
+	// Called with errors which occurred while polling
+	OnError func(err error)
+
+	mu           sync.RWMutex
+	clusters     []cluster
+	lastPoll     time.Time
+	pollDuration time.Duration
+}
+
+// New - create new exporter
+func New(clusters []string, interval time.Duration) *Exporter {
+	return &Exporter{
+		Clusters: clusters,
+		Interval: interval,
+		OnError:  func(error) {},
+	}
+}
+
+// Run - poll clusters on interval until context is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	t := time.NewTicker(e.Interval)
+	defer t.Stop()
+
+	for {
+		e.Poll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Poll - get info about clusters and their instances
+func (e *Exporter) Poll() {
+	startTime := time.Now()
+	clusters := []cluster{}
+
+	arns := e.Clusters
+
+	if len(arns) == 0 {
+		var err error
+		arns, err = aws.GetEcsClusters()
+
+		if err != nil {
+			e.OnError(fmt.Errorf("Couldn't get list of ECS clusters: %v", err))
+			e.store(clusters, startTime)
+			return
+		}
+	}
+
+	if len(arns) > 0 {
+		clustersInfo, err := aws.GetEcsClustersInfo(arns)
+
+		if err != nil {
+			e.OnError(fmt.Errorf("Couldn't get info about ECS clusters: %v", err))
+			e.store(clusters, startTime)
+			return
+		}
+
+		for _, info := range clustersInfo {
+			c := cluster{info: info, up: true}
+
+			instances, err := aws.GetEcsClusterInstances(info.ARN)
+
+			if err == nil && len(instances) > 0 {
+				c.instances, err = aws.GetEcsClusterInstancesInfo(info.ARN, instances)
+			}
+
+			if err != nil {
+				e.OnError(fmt.Errorf("Couldn't get list of instances in ECS cluster %s: %v", info.Name, err))
+				c.up = false
+			}
+
+			clusters = append(clusters, c)
+		}
+	}
+
+	e.store(clusters, startTime)
+}
+
+// store - replace collected data
+func (e *Exporter) store(clusters []cluster, startTime time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.clusters = clusters
+	e.lastPoll = startTime
+	e.pollDuration = time.Since(startTime)
+}
+
+// ServeHTTP - serve collected metrics
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	e.Write(w)
+}
+
+// Write - write collected metrics in Prometheus text exposition format
+func (e *Exporter) Write(w io.Writer) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	clusterMetrics := []struct {
+		metric
+		value func(c cluster) int64
+	}{
+		{clusterRegisteredInstances, func(c cluster) int64 { return c.info.RegisteredInstancesCount }},
+		{clusterRunningTasks, func(c cluster) int64 { return c.info.RunningTasksCount }},
+		{clusterPendingTasks, func(c cluster) int64 { return c.info.PendingTasksCount }},
+		{clusterActiveServices, func(c cluster) int64 { return c.info.ActiveServicesCount }},
+	}
+
+	instanceMetrics := []struct {
+		metric
+		value func(inst aws.EcsInstance) int64
+	}{
+		{instanceRunningTasks, func(inst aws.EcsInstance) int64 { return inst.RunningTasksCount }},
+		{instancePendingTasks, func(inst aws.EcsInstance) int64 { return inst.PendingTasksCount }},
+		{instanceRemainingCPU, func(inst aws.EcsInstance) int64 { return inst.RemainingCPU }},
+		{instanceRemainingMemory, func(inst aws.EcsInstance) int64 { return inst.RemainingMemory }},
+		{instanceRegisteredCPU, func(inst aws.EcsInstance) int64 { return inst.RegisteredCPU }},
+		{instanceRegisteredMem, func(inst aws.EcsInstance) int64 { return inst.RegisteredMemory }},
+	}
+
+	writeHeader(w, clusterUp)
+	for _, c := range e.clusters {
+		up := 0
+		if c.up {
+			up = 1
+		}
+		writeSample(w, clusterUp, clusterLabels(c.info), up)
+	}
+
+	for _, m := range clusterMetrics {
+		writeHeader(w, m.metric)
+		for _, c := range e.clusters {
+			writeSample(w, m.metric, clusterLabels(c.info), m.value(c))
+		}
+	}
+
+	writeHeader(w, instanceInfo)
+	for _, c := range e.clusters {
+		for _, inst := range c.instances {
+			labels := append(instanceLabels(c.info, inst),
+				[2]string{"status", inst.Status},
+				[2]string{"agent_version", inst.AgentVersion},
+				[2]string{"docker_version", inst.DockerVersion},
+				[2]string{"ami", inst.AMI},
+				[2]string{"instance_type", inst.InstanceType},
+			)
+			writeSample(w, instanceInfo, labels, 1)
+		}
+	}
+
+	for _, m := range instanceMetrics {
+		writeHeader(w, m.metric)
+		for _, c := range e.clusters {
+			for _, inst := range c.instances {
+				labels := append(instanceLabels(c.info, inst),
+					[2]string{"agent_version", inst.AgentVersion},
+					[2]string{"ami", inst.AMI},
+				)
+				writeSample(w, m.metric, labels, m.value(inst))
+			}
+		}
+	}
+
+	if !e.lastPoll.IsZero() {
+		writeHeader(w, lastPoll)
+		writeSample(w, lastPoll, nil, float64(e.lastPoll.UnixNano())/1e9)
+		writeHeader(w, lastPollDuration)
+		writeSample(w, lastPollDuration, nil, e.pollDuration.Seconds())
+	}
+}
+
+// clusterLabels - labels identifying cluster
+func clusterLabels(c aws.EcsCluster) [][2]string {
+	return [][2]string{
+		{"cluster", c.Name},
+		{"region", c.Region},
+		{"account", c.Account},
+	}
+}
+
+// instanceLabels - labels identifying instance
+func instanceLabels(c aws.EcsCluster, inst aws.EcsInstance) [][2]string {
+	return append(clusterLabels(c),
+		[2]string{"instance", inst.Name},
+		[2]string{"ec2_instance_id", inst.Ec2InstanceID},
+	)
+}
+
+// writeHeader - write HELP and TYPE lines of metric
+func writeHeader(w io.Writer, m metric) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", namespace, m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s_%s gauge\n", namespace, m.name)
+}
+
+// writeSample - write metric sample
+func writeSample(w io.Writer, m metric, labels [][2]string, value interface{}) {
+	pairs := []string{}
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l[0], escapeLabelValue(l[1])))
+	}
+	sort.Strings(pairs)
+
+	if len(pairs) > 0 {
+		fmt.Fprintf(w, "%s_%s{%s} %v\n", namespace, m.name, strings.Join(pairs, ","), value)
+	} else {
+		fmt.Fprintf(w, "%s_%s %v\n", namespace, m.name, value)
+	}
+}
+
+// escapeLabelValue - escape backslash, double quote and line feed in label value
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
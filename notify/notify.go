@@ -0,0 +1,326 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Target types
+const (
+	// TypeWebhook - generic webhook, message is posted as JSON object
+	TypeWebhook = "webhook"
+	// TypeSlack - Slack compatible incoming webhook, message is posted as {"text": "..."}
+	TypeSlack = "slack"
+)
+
+// Notification events
+const (
+	// EventStart - rotation started
+	EventStart = "start"
+	// EventReplaced - instance was terminated and replaced by a new one
+	EventReplaced = "replaced"
+	// EventFailure - action failed, or rotation gave up
+	EventFailure = "failure"
+	// EventTimeout - wait took longer than allowed
+	EventTimeout = "timeout"
+	// EventFinish - rotation finished, successfully or not
+	EventFinish = "finish"
+)
+
+// Events - all notification events
+var Events = []string{EventStart, EventReplaced, EventFailure, EventTimeout, EventFinish}
+
+// DefaultTemplates - message templates used when target doesn't set its own
+var DefaultTemplates = map[string]string{
+	EventStart:    "Rotation of {{.Total}} instances in cluster {{.Cluster}} started",
+	EventReplaced: "[{{.Index}}/{{.Total}}] Instance {{.Instance}} ({{.Ec2InstanceID}}) in cluster {{.Cluster}} replaced",
+	EventFailure:  "Rotation of cluster {{.Cluster}} failed{{if .Instance}} on instance {{.Instance}} ({{.Ec2InstanceID}}){{end}}: {{.Error}}",
+	EventTimeout:  "Rotation of cluster {{.Cluster}} timed out on instance {{.Instance}} ({{.Ec2InstanceID}}): {{.Error}}",
+	EventFinish:   "Rotation of cluster {{.Cluster}} {{if .Error}}stopped{{else}}finished{{end}} after {{.Duration}}, {{.Replaced}} of {{.Total}} instances replaced{{if .Error}}: {{.Error}}{{end}}",
+}
+
+// Target holds notification target, as set in config file
+type Target struct {
+	// Webhook URL
+	URL string `yaml:"url"`
+	// Target type, webhook or slack
+	Type string `yaml:"type"`
+	// Events to notify about, all events if empty
+	Events []string `yaml:"events"`
+	// Message templates by event, default templates are used for missing events
+	Templates map[string]string `yaml:"templates"`
+}
+
+// Message holds data posted to webhooks and available in templates
+type Message struct {
+	Event         string    `json:"event"`
+	Time          time.Time `json:"time"`
+	Cluster       string    `json:"cluster"`
+	Instance      string    `json:"instance,omitempty"`
+	Ec2InstanceID string    `json:"ec2_instance_id,omitempty"`
+	Index         int       `json:"index,omitempty"`
+	Total         int       `json:"total,omitempty"`
+	Replaced      int       `json:"replaced"`
+	Error         string    `json:"error,omitempty"`
+	Duration      string    `json:"duration,omitempty"`
+	Text          string    `json:"text"`
+}
+
+// Notifier posts rotation events to notification targets. It implements
+// ops.Reporter, so it can be used next to other reporters.
+type Notifier struct {
+	Cluster string
+	Targets []Target
+	// Called when message couldn't be posted
+	OnError func(err error)
+
+	client   *http.Client
+	mu       sync.Mutex
+	active   bool
+	started  time.Time
+	total    int
+	replaced int
+}
+
+// UnmarshalYAML - decode target, rejecting unknown keys, events and invalid templates
+func (t *Target) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("notification must be a map")
+	}
+
+	keys := []string{"url", "type", "events", "templates"}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		if !common.ElementInSlice(node.Content[i].Value, keys) {
+			return fmt.Errorf("unknown key %s in notification, use one of: %s", node.Content[i].Value, strings.Join(keys, ", "))
+		}
+	}
+
+	type plain Target
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+
+	if t.Type == "" {
+		t.Type = TypeWebhook
+	}
+
+	return t.Validate()
+}
+
+// Validate - check URL, type, events and templates of target
+func (t Target) Validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q in notification, use http or https URL", t.URL)
+	}
+
+	if t.Type != TypeWebhook && t.Type != TypeSlack {
+		return fmt.Errorf("invalid type %q in notification, use %s or %s", t.Type, TypeWebhook, TypeSlack)
+	}
+
+	for _, e := range t.Events {
+		if !common.ElementInSlice(e, Events) {
+			return fmt.Errorf("unknown event %q in notification, use one of: %s", e, strings.Join(Events, ", "))
+		}
+	}
+
+	for e, text := range t.Templates {
+		if !common.ElementInSlice(e, Events) {
+			return fmt.Errorf("unknown event %q in notification templates, use one of: %s", e, strings.Join(Events, ", "))
+		}
+
+		if _, err := template.New(e).Parse(text); err != nil {
+			return fmt.Errorf("invalid %s template in notification: %v", e, err)
+		}
+	}
+
+	return nil
+}
+
+// String - describe target without secrets, e.g. "slack https://hooks.slack.com (start, finish)"
+func (t Target) String() string {
+	events := "all events"
+	if len(t.Events) > 0 {
+		events = strings.Join(t.Events, ", ")
+	}
+
+	return fmt.Sprintf("%s %s (%s)", t.Type, redact(t.URL), events)
+}
+
+// Wants - returns true if target should be notified about event
+func (t Target) Wants(event string) bool {
+	return len(t.Events) == 0 || common.ElementInSlice(event, t.Events)
+}
+
+// Render - render message text using target's template for event
+func (t Target) Render(m Message) (string, error) {
+	text, ok := t.Templates[m.Event]
+	if !ok {
+		text = DefaultTemplates[m.Event]
+	}
+
+	tmpl, err := template.New(m.Event).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, m); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// New - create new notifier for cluster
+func New(cluster string, targets []Target) *Notifier {
+	return &Notifier{
+		Cluster: cluster,
+		Targets: targets,
+		OnError: func(error) {},
+		client:  &http.Client{Timeout: 10 * time.Second},
+		started: time.Now(),
+	}
+}
+
+// Report - convert operation event to notification and post it to targets
+func (n *Notifier) Report(e ops.Event) {
+	if len(n.Targets) == 0 {
+		return
+	}
+
+	m, ok := n.message(e)
+	if !ok {
+		return
+	}
+
+	for _, t := range n.Targets {
+		if !t.Wants(m.Event) {
+			continue
+		}
+
+		if err := n.post(t, m); err != nil {
+			n.OnError(fmt.Errorf("Couldn't send %s notification to %s: %v", m.Event, redact(t.URL), err))
+		}
+	}
+}
+
+// message - convert operation event to notification message, returns false
+// if event isn't notified about. Only events between start and finish of
+// rotation are notified about, rotation which failed before it started is
+// notified about as failure.
+func (n *Notifier) message(e ops.Event) (Message, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	m := Message{
+		Time:          e.Time,
+		Cluster:       n.Cluster,
+		Instance:      e.Instance,
+		Ec2InstanceID: e.Ec2InstanceID,
+		Index:         e.Index,
+		Total:         e.Total,
+		Error:         e.Error,
+	}
+
+	switch {
+	case e.Type == ops.EventStart:
+		n.active = true
+		n.started = e.Time
+		n.total = e.Total
+		n.replaced = 0
+		m.Event = EventStart
+	case e.Type == ops.EventFinish && n.active:
+		n.active = false
+		m.Event = EventFinish
+		m.Duration = common.FormatDuration(e.Time.Sub(n.started))
+	case e.Type == ops.EventFinish && e.Error != "":
+		// Rotation failed before it started
+		n.total = 0
+		n.replaced = 0
+		m.Event = EventFailure
+	case !n.active:
+		return m, false
+	case e.Type == ops.EventReplaced:
+		n.replaced++
+		m.Event = EventReplaced
+	case e.Type == ops.EventTimeout:
+		m.Event = EventTimeout
+	case e.Type == ops.EventAction && e.Error != "":
+		m.Event = EventFailure
+		m.Error = fmt.Sprintf("%s: %s", e.Message, e.Error)
+	case e.Type == ops.EventError:
+		m.Event = EventFailure
+		m.Error = e.Message
+	default:
+		return m, false
+	}
+
+	m.Total = n.total
+	m.Replaced = n.replaced
+
+	return m, true
+}
+
+// post - render message and post it to target
+func (n *Notifier) post(t Target, m Message) error {
+	text, err := t.Render(m)
+	if err != nil {
+		return err
+	}
+	m.Text = text
+
+	var body []byte
+
+	if t.Type == TypeSlack {
+		body, err = json.Marshal(map[string]string{"text": text})
+	} else {
+		body, err = json.Marshal(m)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(t.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Don't leak URL in error message
+		if ue, ok := err.(*url.Error); ok {
+			return ue.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	return nil
+}
+
+// redact - strip path and query from URL, webhook URLs usually contain secrets
+func redact(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "webhook"
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+}
@@ -0,0 +1,60 @@
+package ops
+
+import (
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+)
+
+// drainedInstance holds instance drained by operation and when it was drained
+type drainedInstance struct {
+	instance aws.EcsInstance
+	at       time.Time
+}
+
+// trackDrained - remember instance drained by operation
+func (o *Operation) trackDrained(inst aws.EcsInstance) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.untrack(inst)
+	o.drained = append(o.drained, drainedInstance{instance: inst, at: time.Now()})
+}
+
+// untrackDrained - forget instance once it's terminated or activated
+func (o *Operation) untrackDrained(inst aws.EcsInstance) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.untrack(inst)
+}
+
+// untrack - remove instance from drained instances, lock must be held
+func (o *Operation) untrack(inst aws.EcsInstance) {
+	drained := []drainedInstance{}
+
+	for _, d := range o.drained {
+		if d.instance.Name != inst.Name {
+			drained = append(drained, d)
+		}
+	}
+
+	o.drained = drained
+}
+
+// Drained - get instances drained by operation at, or after, given time,
+// which were not terminated or activated since, in order they were drained
+func (o *Operation) Drained(since time.Time) []aws.EcsInstance {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	instances := []aws.EcsInstance{}
+
+	for _, d := range o.drained {
+		if !d.at.Before(since) {
+			instances = append(instances, d.instance)
+		}
+	}
+
+	return instances
+}
@@ -0,0 +1,85 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/hook"
+)
+
+// Decisions returned by Operation.Pause when hook fails
+const (
+	// DecisionRetry - run failed hook again
+	DecisionRetry = "retry"
+	// DecisionContinue - ignore failed hook and continue
+	DecisionContinue = "continue"
+	// DecisionAbort - stop operation
+	DecisionAbort = "abort"
+)
+
+// runHooks - run hooks of given stage on instance. When hook with pause
+// policy fails, Pause decides whether to run it again, ignore it, or stop
+// operation. Hook with abort policy, or failed hook when Pause is not set,
+// stops operation.
+func (o *Operation) runHooks(ctx context.Context, stage string, inst aws.EcsInstance) error {
+	payload := hook.Payload{
+		Stage:         stage,
+		OperationID:   o.ID,
+		Cluster:       o.Cluster.Name,
+		ClusterARN:    o.Cluster.ARN,
+		Instance:      inst.Name,
+		InstanceARN:   inst.ARN,
+		Ec2InstanceID: inst.Ec2InstanceID,
+		AMI:           inst.AMI,
+		InstanceType:  inst.InstanceType,
+	}
+
+	for _, h := range o.Options.Hooks.Stage(stage) {
+		for {
+			output, err := h.Run(ctx, payload)
+
+			// Output of failed hook is reported too, it's needed to find out why it failed
+			for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+				if line != "" {
+					o.report(Event{Type: EventInfo, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: line})
+				}
+			}
+
+			e := Event{Type: EventAction, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Action: ActionHook, Message: fmt.Sprintf("Run %s hook", stage), Result: "DONE"}
+			if err != nil {
+				e.Result = ""
+				e.Error = err.Error()
+			}
+			o.report(e)
+
+			if err == nil {
+				break
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if h.OnFailure != hook.PolicyPause || o.Pause == nil {
+				return err
+			}
+
+			decision := o.Pause(err.Error())
+
+			if decision == DecisionRetry {
+				continue
+			}
+
+			if decision == DecisionContinue {
+				o.report(Event{Type: EventWarning, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: fmt.Sprintf("Failed %s hook ignored", stage)})
+				break
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package ops
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/hook"
+)
+
+func TestRunHooksReportsOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		wantErr bool
+	}{
+		{name: "succeeded", command: "echo first; echo second >&2"},
+		{name: "failed", command: "echo first; echo second >&2; exit 3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			o := newTestOperation(nil, r)
+			o.Options.Hooks = hook.Hooks{BeforeDrain: []hook.Hook{{Command: tt.command, OnFailure: hook.PolicyAbort}}}
+
+			err := o.runHooks(context.Background(), hook.BeforeDrain, aws.EcsInstance{Name: "instance"})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runHooks = %v, want error %v", err, tt.wantErr)
+			}
+
+			output := []string{}
+			for _, e := range r.events {
+				if e.Type == EventInfo {
+					output = append(output, e.Message)
+				}
+			}
+
+			if got := strings.Join(output, ","); got != "first,second" {
+				t.Errorf("reported output %q, want first,second", got)
+			}
+
+			if n := r.count(EventAction); n != 1 {
+				t.Errorf("%d hook actions reported, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,526 @@
+package ops
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/audit"
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/events"
+	"gitlab.com/mzdrale/ecs-manager/hook"
+	"gitlab.com/mzdrale/ecs-manager/window"
+)
+
+// Event types
+const (
+	// EventInstance - started working on instance
+	EventInstance = "instance"
+	// EventAction - action on instance or task finished
+	EventAction = "action"
+	// EventProgress - progress of wait loop, replaces previous progress event
+	EventProgress = "progress"
+	// EventWait - started waiting for something
+	EventWait = "wait"
+	// EventWaitDone - finished waiting
+	EventWaitDone = "wait-done"
+	// EventInfo - informational message
+	EventInfo = "info"
+	// EventWarning - warning message
+	EventWarning = "warning"
+	// EventError - error message
+	EventError = "error"
+	// EventStart - operation on cluster started
+	EventStart = "start"
+	// EventReplaced - instance was terminated and replaced by a new one
+	EventReplaced = "replaced"
+	// EventTimeout - wait took longer than allowed
+	EventTimeout = "timeout"
+	// EventFinish - operation on cluster finished, successfully or not
+	EventFinish = "finish"
+)
+
+// Actions
+const (
+	// ActionUpdateAgent - update ECS agent
+	ActionUpdateAgent = "update-agent"
+	// ActionActivate - set instance state to ACTIVE
+	ActionActivate = "activate"
+	// ActionDrain - set instance state to DRAINING
+	ActionDrain = "drain"
+	// ActionTerminate - terminate EC2 instance
+	ActionTerminate = "terminate"
+	// ActionDrainAndTerminate - drain instance, wait for drain to finish and terminate it
+	ActionDrainAndTerminate = "drain-and-terminate"
+	// ActionStopTask - stop task
+	ActionStopTask = "stop-task"
+	// ActionUpdateAgents - update ECS agent on all instances in cluster
+	ActionUpdateAgents = "update-agents"
+	// ActionRotate - drain and terminate all instances in cluster, one by one
+	ActionRotate = "rotate"
+	// ActionHook - run hook command, it's not an action users can choose
+	ActionHook = "hook"
+)
+
+// Actions - list of actions which can be run on instances
+var Actions = []string{ActionUpdateAgent, ActionActivate, ActionDrain, ActionTerminate, ActionDrainAndTerminate}
+
+// ClusterActions - list of actions which run on all instances in cluster
+var ClusterActions = []string{ActionUpdateAgents, ActionRotate}
+
+// Actions which terminate instances, they need typed confirmation on protected clusters
+var destructiveActions = []string{ActionTerminate, ActionDrainAndTerminate, ActionRotate}
+
+// Actions which are allowed only in change windows
+var windowActions = []string{ActionDrain, ActionTerminate, ActionDrainAndTerminate, ActionRotate}
+
+// Interval between updates of ECS agent on two instances
+const pollInterval = 10 * time.Second
+
+// How many times an action can fail in a row before giving up
+const maxFailures = 5
+
+// ErrNoInstances - returned when there are no instances in cluster
+var ErrNoInstances = errors.New("No instances in cluster, nothing to do")
+
+// ErrStopped - returned when operation is stopped after current instance
+var ErrStopped = errors.New("Stopped after current instance, as requested")
+
+// TimeoutError - returned when wait takes longer than allowed
+type TimeoutError struct {
+	Message string
+	Timeout time.Duration
+}
+
+// Error - format timeout error
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("%s took longer than %s, giving up", e.Message, common.FormatDuration(e.Timeout))
+}
+
+// BlockedError - returned when action is blocked on cluster in config file
+type BlockedError struct {
+	Cluster string
+	Action  string
+}
+
+// Error - format blocked error
+func (e BlockedError) Error() string {
+	return fmt.Sprintf("Action %s is blocked on cluster %s (check config file)", e.Action, e.Cluster)
+}
+
+// Event holds information about progress of an operation
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          string    `json:"type"`
+	Index         int       `json:"index,omitempty"`
+	Total         int       `json:"total,omitempty"`
+	Instance      string    `json:"instance,omitempty"`
+	Ec2InstanceID string    `json:"ec2_instance_id,omitempty"`
+	AMI           string    `json:"ami,omitempty"`
+	Action        string    `json:"action,omitempty"`
+	Result        string    `json:"result,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	// Set on replaced event
+	Replacement *Replacement `json:"replacement,omitempty"`
+}
+
+// Replacement holds how instance was replaced during rotation
+type Replacement struct {
+	// New instance, empty if it couldn't be found, e.g. if it registered
+	// in cluster together with another one
+	NewInstance      string `json:"new_instance,omitempty"`
+	NewEc2InstanceID string `json:"new_ec2_instance_id,omitempty"`
+	NewAMI           string `json:"new_ami,omitempty"`
+	// Time spent draining, waiting for termination and waiting for new instance
+	Drain     time.Duration `json:"drain"`
+	Terminate time.Duration `json:"terminate"`
+	Replace   time.Duration `json:"replace"`
+}
+
+// Result holds result of action on instance
+type Result struct {
+	Instance aws.EcsInstance
+	Result   string
+	Error    error
+}
+
+// Reporter receives events of an operation
+type Reporter interface {
+	Report(e Event)
+}
+
+// ReporterFunc - use ordinary function as Reporter
+type ReporterFunc func(e Event)
+
+// Report - call f(e)
+func (f ReporterFunc) Report(e Event) {
+	f(e)
+}
+
+// Reporters - send events to all reporters, in given order
+func Reporters(reporters ...Reporter) Reporter {
+	return ReporterFunc(func(e Event) {
+		for _, r := range reporters {
+			r.Report(e)
+		}
+	})
+}
+
+// Options holds cluster specific settings used when draining and terminating instances
+type Options struct {
+	// Force stop tasks instead of waiting for drain to finish (test cluster)
+	ForceStopTasks bool
+	// Wait for instances to start task before proceeding to the next one
+	WaitForTask bool
+	// Number of instances allowed to have 0 tasks running when waiting for task
+	NumberOfZeroTasksInstances int
+	// Delay before proceeding to the next instance
+	DrainAndTerminateDelay time.Duration
+	// Stop tasks of DAEMON services once all other tasks are gone
+	StopDaemonTasks bool
+	// Container instance IDs which are not drained and terminated
+	Excluded []string
+	// Destructive actions need cluster name typed as confirmation
+	Protected bool
+	// Actions which can't be run on cluster at all
+	BlockedActions []string
+	// Weekly windows when instances can be drained and terminated, any time if empty
+	ChangeWindows []window.Window
+	// Dates when instances can't be drained and terminated
+	Freeze []window.Freeze
+	// Reason for draining and terminating instances outside of change windows
+	OverrideReason string
+	// How long to wait for drain, termination and replacement of instance, no limit if 0
+	WaitTimeout time.Duration
+	// Commands run before and after draining and terminating instance
+	Hooks hook.Hooks
+	// Container instance IDs rotated in this order, other instances are
+	// excluded. All instances are rotated if empty.
+	Order []string
+	// ECS events waits wake up on, waits only poll if it's not set
+	Events events.Source
+}
+
+// Operation runs actions against instances in ECS cluster and reports progress
+type Operation struct {
+	// ID written to audit log with every action
+	ID       string
+	Cluster  aws.EcsCluster
+	Options  Options
+	Reporter Reporter
+	// Called when hook with pause policy fails, returns DecisionRetry,
+	// DecisionContinue or DecisionAbort. Operation is stopped if it's not set.
+	Pause func(message string) string
+
+	mu sync.Mutex
+	// Instances drained, but not terminated or activated
+	drained []drainedInstance
+	// Set when operation should stop once it's done with current instance
+	stopping atomic.Bool
+	// Set when events couldn't be received, waits only poll from then on
+	eventsFailed atomic.Bool
+}
+
+// New - create new operation
+func New(cluster aws.EcsCluster, options Options, reporter Reporter) *Operation {
+	if reporter == nil {
+		reporter = ReporterFunc(func(Event) {})
+	}
+
+	return &Operation{
+		ID:       NewID(),
+		Cluster:  cluster,
+		Options:  options,
+		Reporter: reporter,
+	}
+}
+
+// Stop - stop operation once it's done with current instance, operation
+// returns ErrStopped
+func (o *Operation) Stop() {
+	o.stopping.Store(true)
+}
+
+// IsDestructive - returns true if action terminates instances
+func IsDestructive(action string) bool {
+	return common.ElementInSlice(action, destructiveActions)
+}
+
+// Allowed - returns BlockedError if action is blocked on cluster, or
+// window.ClosedError if action is not allowed at this time and it's not
+// overridden
+func (o *Operation) Allowed(action string) error {
+	if common.ElementInSlice(action, o.Options.BlockedActions) {
+		return BlockedError{Cluster: o.Cluster.Name, Action: action}
+	}
+
+	if o.Options.OverrideReason == "" {
+		return o.checkWindow(action)
+	}
+
+	return nil
+}
+
+// Begin - check if action is allowed, and if it's run outside of change
+// windows, write override and its reason to audit log
+func (o *Operation) Begin(action string) error {
+	if err := o.Allowed(action); err != nil {
+		return err
+	}
+
+	err := o.checkWindow(action)
+
+	if err == nil {
+		return nil
+	}
+
+	e := audit.Entry{
+		OperationID: o.ID,
+		Cluster:     o.Cluster.ARN,
+		Action:      action,
+		Result:      audit.ResultOverride,
+		Message:     err.Error(),
+		Reason:      o.Options.OverrideReason,
+	}
+
+	if err := audit.Write(e); err != nil {
+		return fmt.Errorf("Couldn't write change window override to audit log, operation not started: %v", err)
+	}
+
+	o.report(Event{Type: EventWarning, Action: action, Message: fmt.Sprintf("%s, overridden: %s", err, o.Options.OverrideReason)})
+
+	return nil
+}
+
+// checkWindow - returns window.ClosedError if action is not allowed at this time
+func (o *Operation) checkWindow(action string) error {
+	if !common.ElementInSlice(action, windowActions) {
+		return nil
+	}
+
+	return window.Check(o.Options.ChangeWindows, o.Options.Freeze, time.Now())
+}
+
+// Instances - get info about all instances in cluster
+func (o *Operation) Instances() ([]aws.EcsInstance, error) {
+	instances, err := aws.GetEcsClusterInstances(o.Cluster.ARN)
+
+	if err != nil || len(instances) == 0 {
+		return []aws.EcsInstance{}, err
+	}
+
+	return aws.GetEcsClusterInstancesInfo(o.Cluster.ARN, instances)
+}
+
+// FindInstances - find instances by container instance ID, EC2 instance ID or ARN
+func (o *Operation) FindInstances(ids []string) ([]aws.EcsInstance, error) {
+	found := []aws.EcsInstance{}
+
+	instances, err := o.Instances()
+
+	if err != nil {
+		return found, err
+	}
+
+	for _, id := range ids {
+		ok := false
+		for _, inst := range instances {
+			if id == inst.Name || id == inst.Ec2InstanceID || id == inst.ARN {
+				found = append(found, inst)
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return found, fmt.Errorf("Instance %s not found in cluster %s", id, o.Cluster.Name)
+		}
+	}
+
+	return found, nil
+}
+
+// UpdateAgent - update ECS agent on instance
+func (o *Operation) UpdateAgent(inst aws.EcsInstance) (string, error) {
+	r, err := aws.UpdateEcsContainerAgent(o.Cluster.ARN, inst.Name)
+	o.audit(ActionUpdateAgent, inst.Name, inst.Ec2InstanceID, r, err)
+	return r, err
+}
+
+// Activate - set instance state to ACTIVE
+func (o *Operation) Activate(inst aws.EcsInstance) (string, error) {
+	r, err := aws.ActivateEcsContainerInstance(o.Cluster.ARN, inst.ARN)
+	o.audit(ActionActivate, inst.Name, inst.Ec2InstanceID, r, err)
+	if err == nil {
+		o.untrackDrained(inst)
+	}
+	return r, err
+}
+
+// Drain - set instance state to DRAINING
+func (o *Operation) Drain(inst aws.EcsInstance) (string, error) {
+	r, err := aws.DrainEcsContainerInstance(o.Cluster.ARN, inst.ARN)
+	o.audit(ActionDrain, inst.Name, inst.Ec2InstanceID, r, err)
+	if err == nil {
+		o.trackDrained(inst)
+	}
+	return r, err
+}
+
+// Terminate - terminate EC2 instance
+func (o *Operation) Terminate(inst aws.EcsInstance) (string, error) {
+	r, err := aws.TerminateEc2Instance(inst.Ec2InstanceID)
+	o.audit(ActionTerminate, inst.Name, inst.Ec2InstanceID, r, err)
+	if err == nil {
+		o.untrackDrained(inst)
+	}
+	return r, err
+}
+
+// StopTask - stop task
+func (o *Operation) StopTask(task aws.EcsTask) (string, error) {
+	r, err := aws.StopEcsTask(o.Cluster.ARN, task.ID)
+	o.audit(ActionStopTask, task.ID, "", r, err)
+	return r, err
+}
+
+// RunOnInstances - run action on instances one by one
+func (o *Operation) RunOnInstances(ctx context.Context, action string, instances []aws.EcsInstance) ([]Result, error) {
+	results := []Result{}
+
+	if err := o.Begin(action); err != nil {
+		return results, err
+	}
+
+	for i, inst := range instances {
+		inst := inst
+
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+
+		if o.stopping.Load() {
+			return results, ErrStopped
+		}
+
+		o.report(Event{Type: EventInstance, Index: i + 1, Total: len(instances), Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID})
+
+		var r string
+		var err error
+
+		switch action {
+		case ActionUpdateAgent:
+			r, err = o.action(inst, action, "Update ECS Agent", func() (string, error) {
+				return o.UpdateAgent(inst)
+			})
+		case ActionActivate:
+			r, err = o.action(inst, action, "Activate instance", func() (string, error) {
+				return o.Activate(inst)
+			})
+		case ActionDrain:
+			r, err = o.DrainInstance(ctx, inst)
+		case ActionTerminate:
+			r, err = o.TerminateInstance(ctx, inst)
+		case ActionDrainAndTerminate:
+			r, err = o.DrainAndTerminate(ctx, inst)
+		default:
+			return results, fmt.Errorf("Unknown action %s", action)
+		}
+
+		results = append(results, Result{Instance: inst, Result: r, Error: err})
+	}
+
+	return results, nil
+}
+
+// audit - write call which changed instance or task to audit log, failure to
+// write it is reported as warning
+func (o *Operation) audit(action string, target string, ec2InstanceID string, result string, err error) {
+	e := audit.Entry{
+		OperationID:   o.ID,
+		Cluster:       o.Cluster.ARN,
+		Action:        action,
+		Target:        target,
+		Ec2InstanceID: ec2InstanceID,
+		Result:        result,
+		Reason:        o.Options.OverrideReason,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if err := audit.Write(e); err != nil {
+		o.report(Event{Type: EventWarning, Instance: target, Ec2InstanceID: ec2InstanceID, Action: action, Message: fmt.Sprintf("Couldn't write audit log: %v", err)})
+	}
+}
+
+// NewID - generate random operation ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkTimeout - report timeout and return TimeoutError if wait started at
+// given time takes longer than allowed
+func (o *Operation) checkTimeout(inst aws.EcsInstance, message string, started time.Time) error {
+	if o.Options.WaitTimeout <= 0 || time.Since(started) < o.Options.WaitTimeout {
+		return nil
+	}
+
+	err := TimeoutError{Message: message, Timeout: o.Options.WaitTimeout}
+	o.report(Event{Type: EventTimeout, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: message, Error: err.Error()})
+
+	return err
+}
+
+// report - send event to reporter
+func (o *Operation) report(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	o.Reporter.Report(e)
+}
+
+// action - run action on instance and report its result
+func (o *Operation) action(inst aws.EcsInstance, action string, message string, f func() (string, error)) (string, error) {
+	r, err := f()
+
+	e := Event{
+		Type:          EventAction,
+		Instance:      inst.Name,
+		Ec2InstanceID: inst.Ec2InstanceID,
+		Action:        action,
+		Result:        r,
+		Message:       message,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	o.report(e)
+
+	return r, err
+}
+
+// sleep - pause for given duration or until context is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,557 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/hook"
+)
+
+// WaitForDrain - wait for all tasks to leave draining instance. Tasks of
+// DAEMON services never leave draining instance, so they are not waited for,
+// but stopped once all other tasks are gone if StopDaemonTasks is set. Tasks
+// with scale-in protection, or whose protection couldn't be checked, are
+// reported and never force stopped.
+func (o *Operation) WaitForDrain(ctx context.Context, inst aws.EcsInstance) error {
+	actionFailedCnt := 0
+	reportedProtectedTasks := []string{}
+	reportedProtectionErr := false
+	started := time.Now()
+	b := o.newBackoff()
+	remainingTasks := -1
+
+	for {
+		if err := o.checkTimeout(inst, "Waiting for drain to finish", started); err != nil {
+			return err
+		}
+
+		// If action failed so many times, give up
+		if actionFailedCnt > maxFailures {
+			return errors.New("Failed too many times, giving up")
+		}
+
+		// Get instance task list
+		tasks, err := aws.GetEcsInstanceTasksInfo(o.Cluster.ARN, inst.Name)
+
+		// Tasks whose protection is unknown are waited for, not force stopped
+		var protectionErr aws.TaskProtectionError
+		if errors.As(err, &protectionErr) {
+			if !reportedProtectionErr {
+				o.report(Event{Type: EventWarning, Instance: inst.Name, Message: fmt.Sprintf("Couldn't get scale-in protection of tasks, they won't be force stopped: %v", protectionErr.Err)})
+				reportedProtectionErr = true
+			}
+			err = nil
+		}
+
+		if err != nil {
+			o.report(Event{Type: EventWarning, Instance: inst.Name, Message: fmt.Sprintf("Couldn't get list of tasks: %v", err)})
+			actionFailedCnt++
+
+			if err := o.wait(ctx, b); err != nil {
+				return err
+			}
+			continue
+		}
+
+		replicaTasks := []aws.EcsTask{}
+		daemonTasks := []aws.EcsTask{}
+		protectedTasksCount := 0
+
+		for _, task := range tasks {
+			if task.Daemon {
+				daemonTasks = append(daemonTasks, task)
+			} else {
+				replicaTasks = append(replicaTasks, task)
+			}
+
+			if task.ProtectionEnabled {
+				protectedTasksCount++
+
+				expires := "unknown"
+				if task.ProtectionExpiresAt != nil {
+					expires = task.ProtectionExpiresAt.Local().Format(time.RFC1123)
+				}
+
+				// Report each protected task only once
+				if !common.ElementInSlice(task.ID, reportedProtectedTasks) {
+					o.report(Event{
+						Type:     EventWarning,
+						Instance: inst.Name,
+						Message:  fmt.Sprintf("Task %s (%s) is protected from scale-in until %s", task.ID, task.Group, expires),
+					})
+					reportedProtectedTasks = append(reportedProtectedTasks, task.ID)
+				}
+			}
+		}
+
+		// Check often while tasks are leaving instance
+		if len(replicaTasks) != remainingTasks {
+			remainingTasks = len(replicaTasks)
+			b.reset()
+		}
+
+		// If all tasks, except daemon ones, are gone, drain is finished
+		if len(replicaTasks) == 0 {
+			if o.Options.StopDaemonTasks {
+				for _, task := range daemonTasks {
+					task := task
+					o.action(inst, ActionStopTask, fmt.Sprintf("Stop daemon task %s (%s)", task.ID, task.ServiceName), func() (string, error) {
+						return o.StopTask(task)
+					})
+				}
+			}
+			return nil
+		}
+
+		// Find first task that can be force stopped
+		var taskToStop *aws.EcsTask
+		if o.Options.ForceStopTasks {
+			for i, task := range replicaTasks {
+				if !task.ProtectionEnabled && !task.ProtectionUnknown {
+					taskToStop = &replicaTasks[i]
+					break
+				}
+			}
+		}
+
+		// If it's test cluster, stop tasks, don't wait for drain to finish
+		if taskToStop != nil {
+			_, err := o.action(inst, ActionStopTask, fmt.Sprintf("Stop task %s", taskToStop.ID), func() (string, error) {
+				return o.StopTask(*taskToStop)
+			})
+
+			if err != nil {
+				actionFailedCnt++
+				continue
+			}
+		} else {
+			status := fmt.Sprintf("%d (need 0)", len(replicaTasks))
+			if len(daemonTasks) > 0 {
+				status = fmt.Sprintf("%s daemon: %d", status, len(daemonTasks))
+			}
+			if protectedTasksCount > 0 {
+				status = fmt.Sprintf("%s protected: %d", status, protectedTasksCount)
+			}
+			o.report(Event{Type: EventProgress, Instance: inst.Name, Message: "Running tasks:", Result: status})
+		}
+
+		if err := o.wait(ctx, b); err != nil {
+			return err
+		}
+	}
+}
+
+// DrainAndTerminate - drain instance, wait for drain to finish and terminate
+// it, running before_drain, after_drain and before_terminate hooks
+func (o *Operation) DrainAndTerminate(ctx context.Context, inst aws.EcsInstance) (string, error) {
+	if err := o.runHooks(ctx, hook.BeforeDrain, inst); err != nil {
+		return "", err
+	}
+
+	r, err := o.action(inst, ActionDrain, "Drain instance", func() (string, error) {
+		return o.Drain(inst)
+	})
+
+	if err != nil {
+		return r, err
+	}
+
+	if err := o.WaitForDrain(ctx, inst); err != nil {
+		// Timeout is already reported
+		var timeout TimeoutError
+		if !errors.As(err, &timeout) {
+			o.report(Event{Type: EventError, Instance: inst.Name, Message: err.Error()})
+		}
+		return r, err
+	}
+
+	if err := o.runHooks(ctx, hook.AfterDrain, inst); err != nil {
+		return r, err
+	}
+
+	return o.TerminateInstance(ctx, inst)
+}
+
+// DrainInstance - drain instance, running before_drain and after_drain hooks.
+// It doesn't wait for drain to finish, after_drain hooks are run once
+// instance is DRAINING.
+func (o *Operation) DrainInstance(ctx context.Context, inst aws.EcsInstance) (string, error) {
+	if err := o.runHooks(ctx, hook.BeforeDrain, inst); err != nil {
+		return "", err
+	}
+
+	r, err := o.action(inst, ActionDrain, "Drain instance", func() (string, error) {
+		return o.Drain(inst)
+	})
+
+	if err != nil {
+		return r, err
+	}
+
+	return r, o.runHooks(ctx, hook.AfterDrain, inst)
+}
+
+// TerminateInstance - terminate instance, running before_terminate hooks
+func (o *Operation) TerminateInstance(ctx context.Context, inst aws.EcsInstance) (string, error) {
+	if err := o.runHooks(ctx, hook.BeforeTerminate, inst); err != nil {
+		return "", err
+	}
+
+	return o.action(inst, ActionTerminate, "Terminate instance", func() (string, error) {
+		return o.Terminate(inst)
+	})
+}
+
+// UpdateAgents - update ECS agent on all instances in cluster
+func (o *Operation) UpdateAgents(ctx context.Context) error {
+	if err := o.Begin(ActionUpdateAgents); err != nil {
+		return err
+	}
+
+	instances, err := o.Instances()
+
+	if err != nil {
+		return err
+	}
+
+	if len(instances) == 0 {
+		return ErrNoInstances
+	}
+
+	failed := 0
+
+	// Iterate through instance list and update container agent
+	for i, inst := range instances {
+		inst := inst
+		o.report(Event{Type: EventInstance, Index: i + 1, Total: len(instances), Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID})
+
+		r, err := o.action(inst, ActionUpdateAgent, "Update ECS Agent", func() (string, error) {
+			return o.UpdateAgent(inst)
+		})
+
+		if err != nil {
+			failed++
+		}
+
+		// Let's wait a few seconds before proceeding to next instance
+		if r == "PENDING" && i < len(instances)-1 {
+			if err := sleep(ctx, pollInterval); err != nil {
+				return err
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to update ECS agent on %d of %d instance(s)", failed, len(instances))
+	}
+
+	return nil
+}
+
+// Rotate - drain and terminate instances in cluster one by one, waiting for
+// each instance to be replaced before proceeding to the next one
+func (o *Operation) Rotate(ctx context.Context) error {
+	if err := o.Begin(ActionRotate); err != nil {
+		return err
+	}
+
+	err := o.rotate(ctx)
+
+	e := Event{Type: EventFinish, Action: ActionRotate, Message: fmt.Sprintf("Drain and terminate instances in cluster %s", o.Cluster.Name)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	o.report(e)
+
+	return err
+}
+
+// rotate - drain and terminate instances, see Rotate
+func (o *Operation) rotate(ctx context.Context) error {
+	// Get cluster info
+	clustersInfo, err := aws.GetEcsClustersInfo([]string{o.Cluster.ARN})
+
+	if err != nil {
+		return fmt.Errorf("Couldn't get cluster info: %v", err)
+	}
+
+	if len(clustersInfo) == 0 {
+		return fmt.Errorf("Cluster %s not found", o.Cluster.ARN)
+	}
+
+	registeredInstancesCount := clustersInfo[0].RegisteredInstancesCount
+
+	instances, err := o.Instances()
+
+	if err != nil {
+		return fmt.Errorf("Couldn't get list of instances in ECS cluster %s: %v", o.Cluster.Name, err)
+	}
+
+	if len(instances) == 0 {
+		return ErrNoInstances
+	}
+
+	if len(o.Options.Order) > 0 {
+		if instances, err = o.orderInstances(instances); err != nil {
+			return err
+		}
+	}
+
+	o.report(Event{Type: EventStart, Action: ActionRotate, Total: len(instances), Message: fmt.Sprintf("Drain and terminate instances in cluster %s", o.Cluster.Name)})
+
+	failed := 0
+
+	// Instances which were in cluster before, so new ones can be told apart
+	known := map[string]bool{}
+	for _, inst := range instances {
+		known[inst.Name] = true
+	}
+
+	// Iterate through instance list and drain and terminate instances
+	for i, inst := range instances {
+		if o.stopping.Load() {
+			return ErrStopped
+		}
+
+		o.report(Event{Type: EventInstance, Index: i + 1, Total: len(instances), Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, AMI: inst.AMI})
+
+		// Check if instance is excluded, or not in order
+		if common.ElementInSlice(inst.Name, o.Options.Excluded) || (len(o.Options.Order) > 0 && !common.ElementInSlice(inst.Name, o.Options.Order)) {
+			o.report(Event{Type: EventAction, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Action: ActionDrain, Message: "Drain instance", Result: "EXCLUDED"})
+			continue
+		}
+
+		if o.Options.WaitForTask {
+			if err := o.waitForClusterReady(ctx); err != nil {
+				return err
+			}
+		}
+
+		replacement := &Replacement{}
+		started := time.Now()
+
+		if _, err := o.DrainAndTerminate(ctx, inst); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// Failed hook stops rotation, instance may be left drained
+			var hookErr hook.Error
+			if errors.As(err, &hookErr) {
+				return err
+			}
+
+			failed++
+			continue
+		}
+
+		replacement.Drain = time.Since(started)
+		started = time.Now()
+
+		if err := o.waitForTermination(ctx, inst); err != nil {
+			return err
+		}
+
+		replacement.Terminate = time.Since(started)
+		started = time.Now()
+
+		if err := o.waitForReplacement(ctx, inst, registeredInstancesCount); err != nil {
+			return err
+		}
+
+		replacement.Replace = time.Since(started)
+
+		if n, ok := o.newInstance(known); ok {
+			replacement.NewInstance = n.Name
+			replacement.NewEc2InstanceID = n.Ec2InstanceID
+			replacement.NewAMI = n.AMI
+		}
+
+		o.report(Event{Type: EventReplaced, Index: i + 1, Total: len(instances), Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Replacement: replacement})
+
+		if err := o.runHooks(ctx, hook.AfterReplacement, inst); err != nil {
+			return err
+		}
+
+		// Wait before proceeding with the next instance
+		if o.Options.DrainAndTerminateDelay > 0 && i < len(instances)-1 && !o.stopping.Load() {
+			message := fmt.Sprintf("Waiting %d seconds", int(o.Options.DrainAndTerminateDelay.Seconds()))
+			o.report(Event{Type: EventWait, Message: message})
+			if err := sleep(ctx, o.Options.DrainAndTerminateDelay); err != nil {
+				return err
+			}
+			o.report(Event{Type: EventWaitDone, Message: message})
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to drain and terminate %d of %d instance(s)", failed, len(instances))
+	}
+
+	return nil
+}
+
+// newInstance - find instance which registered in cluster since it was last
+// checked. It's added to known instances. If more than one instance
+// registered, the new one can't be told, and none is returned.
+func (o *Operation) newInstance(known map[string]bool) (aws.EcsInstance, bool) {
+	instances, err := o.Instances()
+
+	if err != nil {
+		o.report(Event{Type: EventWarning, Message: fmt.Sprintf("Couldn't get list of instances: %v", err)})
+		return aws.EcsInstance{}, false
+	}
+
+	found := []aws.EcsInstance{}
+	for _, inst := range instances {
+		if !known[inst.Name] {
+			known[inst.Name] = true
+			found = append(found, inst)
+		}
+	}
+
+	if len(found) != 1 {
+		return aws.EcsInstance{}, false
+	}
+
+	return found[0], true
+}
+
+// orderInstances - sort instances in order given in options, instances not
+// in order go last. Returns error if instance in order is not in cluster.
+func (o *Operation) orderInstances(instances []aws.EcsInstance) ([]aws.EcsInstance, error) {
+	position := map[string]int{}
+	for i, inst := range instances {
+		position[inst.Name] = len(o.Options.Order) + i
+	}
+
+	for i, id := range o.Options.Order {
+		if _, ok := position[id]; !ok {
+			return instances, fmt.Errorf("Instance %s is not in cluster %s anymore", id, o.Cluster.Name)
+		}
+		position[id] = i
+	}
+
+	sorted := append([]aws.EcsInstance{}, instances...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return position[sorted[i].Name] < position[sorted[j].Name]
+	})
+
+	return sorted, nil
+}
+
+// waitForClusterReady - wait for all instances to get in active state and start task(s)
+func (o *Operation) waitForClusterReady(ctx context.Context) error {
+	message := "Waiting for instances to get in active state and start task(s)"
+	o.report(Event{Type: EventWait, Message: message})
+
+	b := o.newBackoff()
+	failedCnt := 0
+	for {
+		ready, err := aws.IsEcsClusterReady(o.Cluster.ARN, true, o.Options.NumberOfZeroTasksInstances)
+
+		if err != nil {
+			failedCnt++
+			if failedCnt > maxFailures {
+				return err
+			}
+		}
+
+		if ready {
+			break
+		}
+
+		if err := o.wait(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	o.report(Event{Type: EventWaitDone, Message: message})
+	o.report(Event{Type: EventInfo, Message: "All instances are active and running at least one task"})
+
+	return nil
+}
+
+// waitForTermination - wait for EC2 instance to shut down
+func (o *Operation) waitForTermination(ctx context.Context, inst aws.EcsInstance) error {
+	message := "Waiting for instance to shut down"
+	o.report(Event{Type: EventWait, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: message})
+
+	started := time.Now()
+	b := o.newBackoff()
+
+	failedCnt := 0
+	for {
+		if err := o.checkTimeout(inst, message, started); err != nil {
+			return err
+		}
+
+		terminated, err := aws.IsEc2InstanceTerminated(inst.Ec2InstanceID)
+
+		if err != nil {
+			failedCnt++
+			if failedCnt > maxFailures {
+				return err
+			}
+		}
+
+		if terminated {
+			break
+		}
+
+		if err := o.wait(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	o.report(Event{Type: EventWaitDone, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: message})
+	o.report(Event{Type: EventInfo, Instance: inst.Name, Ec2InstanceID: inst.Ec2InstanceID, Message: "Instance terminated, waiting for a new one"})
+
+	return nil
+}
+
+// waitForReplacement - wait for number of registered instances to go back to initial value
+func (o *Operation) waitForReplacement(ctx context.Context, inst aws.EcsInstance, registeredInstancesCount int64) error {
+	started := time.Now()
+	b := o.newBackoff()
+	registered := int64(-1)
+
+	failedCnt := 0
+	for {
+		if err := o.checkTimeout(inst, "Waiting for a new instance", started); err != nil {
+			return err
+		}
+
+		// Get cluster info
+		r, err := aws.GetEcsClustersInfo([]string{o.Cluster.ARN})
+
+		if err != nil || len(r) == 0 {
+			failedCnt++
+			if failedCnt > maxFailures {
+				return fmt.Errorf("Couldn't get cluster info: %v", err)
+			}
+		} else {
+			o.report(Event{Type: EventProgress, Message: "Registered instances count:", Result: fmt.Sprintf("%d (need %d)", r[0].RegisteredInstancesCount, registeredInstancesCount)})
+
+			// If registered instances count is back to initial value (all instances in cluster), stop the loop
+			if r[0].RegisteredInstancesCount >= registeredInstancesCount {
+				return nil
+			}
+
+			// Check often while instances are registering and deregistering
+			if r[0].RegisteredInstancesCount != registered {
+				registered = r[0].RegisteredInstancesCount
+				b.reset()
+			}
+		}
+
+		if err := o.wait(ctx, b); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Interval between two checks in wait loops grows from minPollInterval to
+// maxPollInterval while nothing changes. When waits wake up on events,
+// polling is only a fallback and backs off up to maxEventsPollInterval.
+const (
+	minPollInterval       = 5 * time.Second
+	maxPollInterval       = 30 * time.Second
+	maxEventsPollInterval = 2 * time.Minute
+)
+
+// backoff holds interval until the next check in wait loop
+type backoff struct {
+	interval time.Duration
+	max      time.Duration
+}
+
+// newBackoff - create backoff for wait loop
+func (o *Operation) newBackoff() *backoff {
+	b := &backoff{interval: minPollInterval, max: maxPollInterval}
+
+	if o.Options.Events != nil && !o.eventsFailed.Load() {
+		b.max = maxEventsPollInterval
+	}
+
+	return b
+}
+
+// next - get interval until the next check and increase it by half, up to maximum
+func (b *backoff) next() time.Duration {
+	d := b.interval
+
+	b.interval = b.interval * 3 / 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+
+	return d
+}
+
+// reset - check often again, state is changing
+func (b *backoff) reset() {
+	b.interval = minPollInterval
+}
+
+// wait - wait until the next check in wait loop. If events are set, wait
+// ends as soon as state of task or container instance in cluster changes.
+// If events can't be received, warning is reported and waits only poll for
+// the rest of operation.
+func (o *Operation) wait(ctx context.Context, b *backoff) error {
+	interval := b.next()
+
+	if o.Options.Events == nil || o.eventsFailed.Load() {
+		return sleep(ctx, interval)
+	}
+
+	deadline := time.Now().Add(interval)
+
+	waitCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for {
+		events, err := o.Options.Events.Receive(waitCtx)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			o.eventsFailed.Store(true)
+			b.max = maxPollInterval
+			o.report(Event{Type: EventWarning, Message: fmt.Sprintf("Couldn't receive ECS events, falling back to polling: %v", err)})
+			return sleep(ctx, time.Until(deadline))
+		}
+
+		// Nothing happened until the next check
+		if len(events) == 0 {
+			return nil
+		}
+
+		for _, e := range events {
+			if e.IsStateChange(o.Cluster.ARN) {
+				b.reset()
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/events"
+)
+
+const testClusterARN = "arn:aws:ecs:eu-west-1:123456789012:cluster/test"
+
+// failingSource - events source which can't receive events
+type failingSource struct {
+	calls atomic.Int32
+}
+
+// Receive - count call and fail
+func (s *failingSource) Receive(ctx context.Context) ([]events.Event, error) {
+	s.calls.Add(1)
+	return nil, errors.New("queue does not exist")
+}
+
+// recorder - reporter keeping reported events
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Report - keep event
+func (r *recorder) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// count - number of reported events of given type
+func (r *recorder) count(t string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, e := range r.events {
+		if e.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestOperation(source events.Source, reporter Reporter) *Operation {
+	return New(aws.EcsCluster{ARN: testClusterARN, Name: "test"}, Options{Events: source}, reporter)
+}
+
+func TestBackoffGrowsToCap(t *testing.T) {
+	tests := []struct {
+		name   string
+		events events.Source
+		max    time.Duration
+	}{
+		{name: "polling", events: nil, max: maxPollInterval},
+		{name: "events", events: events.NewLocal(), max: maxEventsPollInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestOperation(tt.events, nil).newBackoff()
+
+			if d := b.next(); d != minPollInterval {
+				t.Fatalf("first interval = %v, want %v", d, minPollInterval)
+			}
+
+			prev := minPollInterval
+			for i := 0; i < 20; i++ {
+				d := b.next()
+				if d < prev {
+					t.Fatalf("interval decreased from %v to %v", prev, d)
+				}
+				if d > tt.max {
+					t.Fatalf("interval %v is over cap %v", d, tt.max)
+				}
+				prev = d
+			}
+
+			if prev != tt.max {
+				t.Errorf("interval = %v after 20 waits, want cap %v", prev, tt.max)
+			}
+
+			b.reset()
+			if d := b.next(); d != minPollInterval {
+				t.Errorf("interval after reset = %v, want %v", d, minPollInterval)
+			}
+		})
+	}
+}
+
+func TestWaitWakesOnEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event events.Event
+		wake  bool
+	}{
+		{
+			name:  "task state change",
+			event: events.Event{DetailType: events.TaskStateChange, Detail: events.Detail{ClusterARN: testClusterARN}},
+			wake:  true,
+		},
+		{
+			name:  "container instance state change",
+			event: events.Event{DetailType: events.ContainerInstanceStateChange, Detail: events.Detail{ClusterARN: testClusterARN}},
+			wake:  true,
+		},
+		{
+			name:  "other cluster",
+			event: events.Event{DetailType: events.TaskStateChange, Detail: events.Detail{ClusterARN: testClusterARN + "-other"}},
+			wake:  false,
+		},
+		{
+			name:  "other detail type",
+			event: events.Event{DetailType: "ECS Deployment State Change", Detail: events.Detail{ClusterARN: testClusterARN}},
+			wake:  false,
+		},
+	}
+
+	const interval = 500 * time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := events.NewLocal()
+			o := newTestOperation(local, nil)
+			b := &backoff{interval: interval, max: maxEventsPollInterval}
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				local.Send(tt.event)
+			}()
+
+			started := time.Now()
+			if err := o.wait(context.Background(), b); err != nil {
+				t.Fatalf("wait failed: %v", err)
+			}
+			elapsed := time.Since(started)
+
+			if tt.wake {
+				if elapsed >= interval {
+					t.Errorf("wait took %v, want to wake up on event before %v", elapsed, interval)
+				}
+				if b.interval != minPollInterval {
+					t.Errorf("interval after event = %v, want reset to %v", b.interval, minPollInterval)
+				}
+			} else {
+				if elapsed < interval {
+					t.Errorf("wait took %v, want to ignore event and wait %v", elapsed, interval)
+				}
+				if b.interval != interval*3/2 {
+					t.Errorf("interval after wait = %v, want %v", b.interval, interval*3/2)
+				}
+			}
+
+			if o.eventsFailed.Load() {
+				t.Error("events marked as failed")
+			}
+		})
+	}
+}
+
+func TestWaitFallsBackToPolling(t *testing.T) {
+	source := &failingSource{}
+	r := &recorder{}
+	o := newTestOperation(source, r)
+
+	const interval = 100 * time.Millisecond
+	b := &backoff{interval: interval, max: maxEventsPollInterval}
+
+	started := time.Now()
+	if err := o.wait(context.Background(), b); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed < interval {
+		t.Errorf("wait took %v, want to sleep until next check after %v", elapsed, interval)
+	}
+
+	if !o.eventsFailed.Load() {
+		t.Error("events not marked as failed")
+	}
+
+	if b.max != maxPollInterval {
+		t.Errorf("backoff cap = %v, want %v", b.max, maxPollInterval)
+	}
+
+	if n := r.count(EventWarning); n != 1 {
+		t.Errorf("%d warnings reported, want 1", n)
+	}
+
+	if nb := o.newBackoff(); nb.max != maxPollInterval {
+		t.Errorf("new backoff cap = %v, want %v", nb.max, maxPollInterval)
+	}
+
+	// Later waits only poll
+	b = &backoff{interval: interval, max: maxPollInterval}
+	if err := o.wait(context.Background(), b); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	if n := source.calls.Load(); n != 1 {
+		t.Errorf("source called %d times, want 1", n)
+	}
+
+	if n := r.count(EventWarning); n != 1 {
+		t.Errorf("%d warnings reported, want 1", n)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	o := newTestOperation(events.NewLocal(), nil)
+	b := &backoff{interval: time.Minute, max: maxEventsPollInterval}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	if err := o.wait(ctx, b); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait returned %v, want %v", err, context.Canceled)
+	}
+}
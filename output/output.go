@@ -0,0 +1,230 @@
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats
+const (
+	// Table - human readable table
+	Table = "table"
+	// JSON - JSON array
+	JSON = "json"
+	// YAML - YAML list
+	YAML = "yaml"
+	// CSV - CSV with header
+	CSV = "csv"
+	// Markdown - Markdown table
+	Markdown = "markdown"
+	// HTML - HTML table
+	HTML = "html"
+)
+
+// Formats - list of supported output formats
+var Formats = []string{Table, JSON, YAML, CSV, Markdown, HTML}
+
+// IsValidFormat - returns true if output format is supported
+func IsValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Write - write items in given format. Items must be a slice of structs, field
+// names are taken from json tags. Table shows only given columns, or all of
+// them if no columns are given.
+func Write(w io.Writer, format string, items interface{}, columns ...string) error {
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	case YAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(items); err != nil {
+			return err
+		}
+		return enc.Close()
+	case CSV:
+		header, rows, err := toRows(items, nil)
+		if err != nil {
+			return err
+		}
+
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	case Markdown:
+		header, rows, err := toRows(items, nil)
+		if err != nil {
+			return err
+		}
+
+		separator := []string{}
+		for range header {
+			separator = append(separator, "---")
+		}
+
+		fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+		fmt.Fprintf(w, "| %s |\n", strings.Join(separator, " | "))
+		for _, row := range rows {
+			for i, c := range row {
+				row[i] = strings.Replace(c, "|", "\\|", -1)
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+		}
+		return nil
+	case HTML:
+		header, rows, err := toRows(items, nil)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, "<table>")
+		fmt.Fprintln(w, "  <tr>")
+		for _, h := range header {
+			fmt.Fprintf(w, "    <th>%s</th>\n", html.EscapeString(h))
+		}
+		fmt.Fprintln(w, "  </tr>")
+		for _, row := range rows {
+			fmt.Fprintln(w, "  <tr>")
+			for _, c := range row {
+				fmt.Fprintf(w, "    <td>%s</td>\n", html.EscapeString(c))
+			}
+			fmt.Fprintln(w, "  </tr>")
+		}
+		fmt.Fprintln(w, "</table>")
+		return nil
+	case Table:
+		header, rows, err := toRows(items, columns)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for i, h := range header {
+			header[i] = strings.ToUpper(strings.Replace(h, "_", " ", -1))
+		}
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+
+	return fmt.Errorf("Unsupported output format %s, use one of: %s", format, strings.Join(Formats, ", "))
+}
+
+// field holds name and index of struct field
+type field struct {
+	name  string
+	index []int
+}
+
+// fields - get exported fields of struct type, including fields of embedded structs
+func fields(t reflect.Type, index []int) []field {
+	fs := []field{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		idx := append(append([]int{}, index...), i)
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fs = append(fs, fields(f.Type, idx)...)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fs = append(fs, field{name: name, index: idx})
+	}
+
+	return fs
+}
+
+// toRows - convert slice of structs to header and rows of strings
+func toRows(items interface{}, columns []string) ([]string, [][]string, error) {
+	v := reflect.ValueOf(items)
+
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("Can't write %T, slice of structs expected", items)
+	}
+
+	fs := fields(v.Type().Elem(), nil)
+
+	// Keep only selected columns, in given order
+	if len(columns) > 0 {
+		selected := []field{}
+		for _, c := range columns {
+			for _, f := range fs {
+				if f.name == c {
+					selected = append(selected, f)
+				}
+			}
+		}
+		fs = selected
+	}
+
+	header := []string{}
+	for _, f := range fs {
+		header = append(header, f.name)
+	}
+
+	rows := [][]string{}
+	for i := 0; i < v.Len(); i++ {
+		row := []string{}
+		for _, f := range fs {
+			row = append(row, formatValue(v.Index(i).FieldByIndex(f.index)))
+		}
+		rows = append(rows, row)
+	}
+
+	return header, rows, nil
+}
+
+// formatValue - format field value as string
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Format(time.RFC3339)
+	case []string:
+		return strings.Join(value, ",")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,303 @@
+package plan
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version - version of plan file format
+const Version = 1
+
+// Plan holds everything rotation of cluster depends on, resolved when plan is
+// created, so it can be reviewed before it's applied
+type Plan struct {
+	Version    int       `yaml:"version"`
+	CreatedAt  time.Time `yaml:"created_at"`
+	CreatedBy  string    `yaml:"created_by"`
+	Cluster    string    `yaml:"cluster"`
+	ClusterARN string    `yaml:"cluster_arn"`
+	Settings   Settings  `yaml:"settings"`
+	Gates      Gates     `yaml:"gates"`
+	Timeouts   Timeouts  `yaml:"timeouts"`
+	// All instances in cluster when plan was created, including excluded ones
+	Instances []Instance `yaml:"instances"`
+	// Batches are rotated in this order
+	Batches []Batch `yaml:"batches"`
+}
+
+// Batch holds container instance IDs replaced together
+type Batch []string
+
+// Settings holds how instances are drained
+type Settings struct {
+	ForceStopTasks  bool `yaml:"force_stop_tasks"`
+	StopDaemonTasks bool `yaml:"stop_daemon_tasks"`
+}
+
+// Gates holds conditions which have to be met before the next batch is rotated
+type Gates struct {
+	WaitForTask                bool `yaml:"wait_for_task"`
+	NumberOfZeroTasksInstances int  `yaml:"number_of_zero_tasks_instances"`
+	// Delay in seconds
+	Delay int `yaml:"delay"`
+}
+
+// Timeouts holds timeouts in seconds, 0 means no limit
+type Timeouts struct {
+	// Drain, termination and replacement of instance
+	Wait int `yaml:"wait"`
+}
+
+// Instance holds instance in cluster when plan was created
+type Instance struct {
+	ID            string `yaml:"id"`
+	Ec2InstanceID string `yaml:"ec2_instance_id"`
+	AMI           string `yaml:"ami"`
+	InstanceType  string `yaml:"instance_type"`
+	Excluded      bool   `yaml:"excluded,omitempty"`
+	// Exclusion rule, as written in exclude list
+	ExcludeRule string `yaml:"exclude_rule,omitempty"`
+}
+
+// New - create plan rotating all instances in cluster, one by one, except
+// excluded ones. Excluded instances are given as container instance ID to
+// exclusion rule map.
+func New(cluster aws.EcsCluster, opts ops.Options, instances []aws.EcsInstance, excluded map[string]string) Plan {
+	p := Plan{
+		Version:    Version,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		CreatedBy:  fmt.Sprintf("%s@%s", common.CurrentUser(), common.Hostname()),
+		Cluster:    cluster.Name,
+		ClusterARN: cluster.ARN,
+		Settings: Settings{
+			ForceStopTasks:  opts.ForceStopTasks,
+			StopDaemonTasks: opts.StopDaemonTasks,
+		},
+		Gates: Gates{
+			WaitForTask:                opts.WaitForTask,
+			NumberOfZeroTasksInstances: opts.NumberOfZeroTasksInstances,
+			Delay:                      int(opts.DrainAndTerminateDelay.Seconds()),
+		},
+		Timeouts: Timeouts{
+			Wait: int(opts.WaitTimeout.Seconds()),
+		},
+		Instances: []Instance{},
+		Batches:   []Batch{},
+	}
+
+	for _, inst := range instances {
+		rule, ok := excluded[inst.Name]
+
+		p.Instances = append(p.Instances, Instance{
+			ID:            inst.Name,
+			Ec2InstanceID: inst.Ec2InstanceID,
+			AMI:           inst.AMI,
+			InstanceType:  inst.InstanceType,
+			Excluded:      ok,
+			ExcludeRule:   rule,
+		})
+
+		if !ok {
+			p.Batches = append(p.Batches, Batch{inst.Name})
+		}
+	}
+
+	return p
+}
+
+// MarshalYAML - write batch in flow style, e.g. [id]
+func (b Batch) MarshalYAML() (interface{}, error) {
+	n := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+
+	for _, id := range b {
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: id})
+	}
+
+	return n, nil
+}
+
+// Read - read and validate plan file
+func Read(filename string) (Plan, error) {
+	var p Plan
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return p, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&p); err != nil {
+		return p, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return p, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return p, nil
+}
+
+// Write - write plan to file, or to stdout if filename is "-"
+func (p Plan) Write(filename string) error {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "# Rotation plan of cluster %s, apply it with:\n", p.Cluster)
+	fmt.Fprintf(&b, "#   ecs-manager cluster apply --plan <file>\n")
+	fmt.Fprintf(&b, "# Plan is refused if instances in cluster change before it's applied.\n")
+
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(p); err != nil {
+		return err
+	}
+
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if filename == "-" {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+
+	return os.WriteFile(filename, b.Bytes(), 0644)
+}
+
+// Validate - check version, gates, timeouts and batches of plan
+func (p Plan) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("unsupported plan version %d, expected %d", p.Version, Version)
+	}
+
+	if p.ClusterARN == "" {
+		return fmt.Errorf("cluster_arn is not set")
+	}
+
+	if p.Gates.NumberOfZeroTasksInstances < 0 || p.Gates.Delay < 0 || p.Timeouts.Wait < 0 {
+		return fmt.Errorf("gates and timeouts can't be negative")
+	}
+
+	instances := map[string]Instance{}
+	for _, inst := range p.Instances {
+		instances[inst.ID] = inst
+	}
+
+	seen := map[string]bool{}
+
+	for i, batch := range p.Batches {
+		// Instances are replaced one by one
+		if len(batch) != 1 {
+			return fmt.Errorf("batch %d has %d instances, batches of exactly one instance are supported", i+1, len(batch))
+		}
+
+		for _, id := range batch {
+			inst, ok := instances[id]
+
+			if !ok {
+				return fmt.Errorf("instance %s in batch %d is not listed in instances", id, i+1)
+			}
+
+			if inst.Excluded {
+				return fmt.Errorf("instance %s in batch %d is excluded", id, i+1)
+			}
+
+			if seen[id] {
+				return fmt.Errorf("instance %s is in more than one batch", id)
+			}
+
+			seen[id] = true
+		}
+	}
+
+	return nil
+}
+
+// Order - get container instance IDs in order they are rotated
+func (p Plan) Order() []string {
+	order := []string{}
+	for _, batch := range p.Batches {
+		order = append(order, batch...)
+	}
+	return order
+}
+
+// Excluded - get container instance IDs of excluded instances
+func (p Plan) Excluded() []string {
+	excluded := []string{}
+	for _, inst := range p.Instances {
+		if inst.Excluded {
+			excluded = append(excluded, inst.ID)
+		}
+	}
+	return excluded
+}
+
+// Options - apply settings, gates and timeouts of plan to cluster options.
+// Other options, e.g. protection, change windows and hooks, are kept.
+func (p Plan) Options(opts ops.Options) ops.Options {
+	opts.ForceStopTasks = p.Settings.ForceStopTasks
+	opts.StopDaemonTasks = p.Settings.StopDaemonTasks
+	opts.WaitForTask = p.Gates.WaitForTask
+	opts.NumberOfZeroTasksInstances = p.Gates.NumberOfZeroTasksInstances
+	opts.DrainAndTerminateDelay = time.Duration(p.Gates.Delay) * time.Second
+	opts.WaitTimeout = time.Duration(p.Timeouts.Wait) * time.Second
+	opts.Excluded = p.Excluded()
+	opts.Order = p.Order()
+
+	return opts
+}
+
+// Drift - compare instances in cluster with instances in plan, returns
+// differences which make plan invalid: new instances, missing instances and
+// instances backed by another EC2 instance
+func (p Plan) Drift(instances []aws.EcsInstance) []string {
+	drift := []string{}
+
+	current := map[string]aws.EcsInstance{}
+	for _, inst := range instances {
+		current[inst.Name] = inst
+	}
+
+	planned := map[string]Instance{}
+	for _, inst := range p.Instances {
+		planned[inst.ID] = inst
+
+		c, ok := current[inst.ID]
+
+		if !ok {
+			drift = append(drift, fmt.Sprintf("instance %s (%s) is not in cluster anymore", inst.ID, inst.Ec2InstanceID))
+			continue
+		}
+
+		if c.Ec2InstanceID != inst.Ec2InstanceID {
+			drift = append(drift, fmt.Sprintf("instance %s is EC2 instance %s, plan has %s", inst.ID, c.Ec2InstanceID, inst.Ec2InstanceID))
+		}
+	}
+
+	for _, inst := range instances {
+		if _, ok := planned[inst.Name]; !ok {
+			drift = append(drift, fmt.Sprintf("instance %s (%s) is not in plan", inst.Name, inst.Ec2InstanceID))
+		}
+	}
+
+	sort.Strings(drift)
+
+	return drift
+}
+
+// String - describe plan in one line
+func (p Plan) String() string {
+	return fmt.Sprintf("%d of %d instances in cluster %s, planned by %s on %s", len(p.Order()), len(p.Instances), p.Cluster, p.CreatedBy, p.CreatedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,180 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+)
+
+// testPlan - plan with instances a, b and excluded c, rotating a and b
+func testPlan() Plan {
+	return Plan{
+		Version:    Version,
+		Cluster:    "prod",
+		ClusterARN: "arn:aws:ecs:eu-west-1:123456789012:cluster/prod",
+		Instances: []Instance{
+			{ID: "a", Ec2InstanceID: "i-a"},
+			{ID: "b", Ec2InstanceID: "i-b"},
+			{ID: "c", Ec2InstanceID: "i-c", Excluded: true, ExcludeRule: "i-c"},
+		},
+		Batches: []Batch{{"a"}, {"b"}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(p *Plan)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			change: func(p *Plan) {},
+		},
+		{
+			name:   "nothing to rotate",
+			change: func(p *Plan) { p.Batches = nil },
+		},
+		{
+			name:    "unsupported version",
+			change:  func(p *Plan) { p.Version = 2 },
+			wantErr: "unsupported plan version 2, expected 1",
+		},
+		{
+			name:    "missing cluster ARN",
+			change:  func(p *Plan) { p.ClusterARN = "" },
+			wantErr: "cluster_arn is not set",
+		},
+		{
+			name:    "negative delay",
+			change:  func(p *Plan) { p.Gates.Delay = -1 },
+			wantErr: "gates and timeouts can't be negative",
+		},
+		{
+			name:    "negative zero tasks instances",
+			change:  func(p *Plan) { p.Gates.NumberOfZeroTasksInstances = -1 },
+			wantErr: "gates and timeouts can't be negative",
+		},
+		{
+			name:    "negative timeout",
+			change:  func(p *Plan) { p.Timeouts.Wait = -1 },
+			wantErr: "gates and timeouts can't be negative",
+		},
+		{
+			name:    "batch of two instances",
+			change:  func(p *Plan) { p.Batches = []Batch{{"a", "b"}} },
+			wantErr: "batch 1 has 2 instances",
+		},
+		{
+			name:    "empty batch",
+			change:  func(p *Plan) { p.Batches = []Batch{{"a"}, {}} },
+			wantErr: "batch 2 has 0 instances",
+		},
+		{
+			name:    "unknown instance",
+			change:  func(p *Plan) { p.Batches = []Batch{{"a"}, {"d"}} },
+			wantErr: "instance d in batch 2 is not listed in instances",
+		},
+		{
+			name:    "excluded instance",
+			change:  func(p *Plan) { p.Batches = []Batch{{"c"}} },
+			wantErr: "instance c in batch 1 is excluded",
+		},
+		{
+			name:    "instance in two batches",
+			change:  func(p *Plan) { p.Batches = []Batch{{"a"}, {"b"}, {"a"}} },
+			wantErr: "instance a is in more than one batch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPlan()
+			tt.change(&p)
+
+			err := p.Validate()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDrift(t *testing.T) {
+	instance := func(id string, ec2InstanceID string) aws.EcsInstance {
+		return aws.EcsInstance{Name: id, Ec2InstanceID: ec2InstanceID}
+	}
+
+	tests := []struct {
+		name      string
+		instances []aws.EcsInstance
+		want      []string
+	}{
+		{
+			name:      "no drift",
+			instances: []aws.EcsInstance{instance("c", "i-c"), instance("a", "i-a"), instance("b", "i-b")},
+			want:      []string{},
+		},
+		{
+			name:      "missing instance",
+			instances: []aws.EcsInstance{instance("a", "i-a"), instance("c", "i-c")},
+			want:      []string{"instance b (i-b) is not in cluster anymore"},
+		},
+		{
+			name:      "missing excluded instance",
+			instances: []aws.EcsInstance{instance("a", "i-a"), instance("b", "i-b")},
+			want:      []string{"instance c (i-c) is not in cluster anymore"},
+		},
+		{
+			name:      "new instance",
+			instances: []aws.EcsInstance{instance("a", "i-a"), instance("b", "i-b"), instance("c", "i-c"), instance("d", "i-d")},
+			want:      []string{"instance d (i-d) is not in plan"},
+		},
+		{
+			name:      "another EC2 instance",
+			instances: []aws.EcsInstance{instance("a", "i-a2"), instance("b", "i-b"), instance("c", "i-c")},
+			want:      []string{"instance a is EC2 instance i-a2, plan has i-a"},
+		},
+		{
+			name:      "sorted",
+			instances: []aws.EcsInstance{instance("d", "i-d"), instance("b", "i-b2")},
+			want: []string{
+				"instance a (i-a) is not in cluster anymore",
+				"instance b is EC2 instance i-b2, plan has i-b",
+				"instance c (i-c) is not in cluster anymore",
+				"instance d (i-d) is not in plan",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testPlan().Drift(tt.instances)
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Drift = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderAndExcluded(t *testing.T) {
+	p := testPlan()
+
+	if got := strings.Join(p.Order(), ","); got != "a,b" {
+		t.Errorf("Order = %s, want a,b", got)
+	}
+
+	if got := strings.Join(p.Excluded(), ","); got != "c" {
+		t.Errorf("Excluded = %s, want c", got)
+	}
+}
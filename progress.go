@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/history"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+)
+
+// Width of progress bar, in characters
+const progressBarWidth = 30
+
+// rotationProgress tracks how many instances rotation replaced and estimates
+// how long the rest will take
+type rotationProgress struct {
+	mu sync.Mutex
+	// Time it takes to replace one instance, from past rotations, 0 if unknown
+	estimate time.Duration
+	started  time.Time
+	// Time the last instance was replaced
+	replaced time.Time
+	total    int
+	done     int
+}
+
+// newRotationProgress - create progress of rotation of cluster, initial
+// estimate is taken from history of its past rotations
+func newRotationProgress(clust aws.EcsCluster) *rotationProgress {
+	estimate, _ := history.Estimate(clust.ARN)
+	return &rotationProgress{estimate: estimate}
+}
+
+// Report - count replaced instances, excluded instances are not counted in total
+func (r *rotationProgress) Report(e ops.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch e.Type {
+	case ops.EventStart:
+		r.started = e.Time
+		r.total = e.Total
+	case ops.EventAction:
+		if e.Result == "EXCLUDED" && r.total > 0 {
+			r.total--
+		}
+	case ops.EventReplaced:
+		r.done++
+		r.replaced = e.Time
+	}
+}
+
+// perInstance - get average time it took to replace one instance so far, or
+// estimate from history before the first instance is replaced
+func (r *rotationProgress) perInstance() time.Duration {
+	if r.done > 0 {
+		return r.replaced.Sub(r.started) / time.Duration(r.done)
+	}
+	return r.estimate
+}
+
+// String - format progress bar with replaced and total instances, elapsed
+// time and estimated time left
+func (r *rotationProgress) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filled := 0
+	if r.total > 0 {
+		filled = progressBarWidth * r.done / r.total
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	line := fmt.Sprintf("[%s] %d/%d replaced, elapsed %s", bar, r.done, r.total, common.FormatDuration(time.Since(r.started).Round(time.Second)))
+
+	if perInstance := r.perInstance(); perInstance > 0 && r.done < r.total {
+		// Time spent on current instance is already behind us
+		left := perInstance*time.Duration(r.total-r.done) - time.Since(r.replacedOrStarted())
+		if left < 0 {
+			left = 0
+		}
+		line += fmt.Sprintf(", ETA %s", common.FormatDuration(left.Round(time.Minute)))
+	}
+
+	return line
+}
+
+// replacedOrStarted - get time the last instance was replaced, or rotation started
+func (r *rotationProgress) replacedOrStarted() time.Time {
+	if r.done > 0 {
+		return r.replaced
+	}
+	return r.started
+}
+
+// record - add finished rotation to history, so it can be used to estimate
+// next rotations of cluster
+func (r *rotationProgress) record(clust aws.EcsCluster) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return history.Record(history.Rotation{
+		Time:     r.replaced,
+		Cluster:  clust.ARN,
+		Replaced: r.done,
+		Duration: r.replaced.Sub(r.started),
+	})
+}
+
+// rotationEstimate - describe how long rotating given number of instances in
+// cluster will take, based on its past rotations, e.g. " (estimated 2h 30m 0s)".
+// Empty if cluster wasn't rotated before.
+func rotationEstimate(clust aws.EcsCluster, count int) string {
+	perInstance, ok := history.Estimate(clust.ARN)
+
+	if !ok || count <= 0 {
+		return ""
+	}
+
+	estimate := (perInstance * time.Duration(count)).Round(time.Minute)
+
+	return fmt.Sprintf(" (estimated %s)", common.FormatDuration(estimate))
+}
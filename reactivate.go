@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+)
+
+// offerReactivation - list instances operation drained since given time, but
+// didn't terminate, and offer to reactivate them. It's called when operation
+// failed, was aborted or interrupted.
+func offerReactivation(op *ops.Operation, since time.Time) {
+	drained := op.Drained(since)
+
+	if len(drained) == 0 {
+		return
+	}
+
+	fmt.Printf(p.Warn("\U000026A0 %d instance(s) drained, but not terminated:\n"), len(drained))
+	for _, inst := range drained {
+		fmt.Printf("   \U0000276F %s (%s)\n", inst.Name, inst.Ec2InstanceID)
+	}
+
+	if !common.IsTerminal(os.Stdin) {
+		fmt.Printf(p.Info("\U0000276F Reactivate them with: %s instance activate --cluster %s <instance-id>...\n"), filepath.Base(os.Args[0]), op.Cluster.Name)
+		return
+	}
+
+	if !confirm("Do you want to reactivate them", false) {
+		return
+	}
+
+	reactivate(op, drained)
+}
+
+// reactivateDraining - select DRAINING instances in cluster and reactivate them
+func reactivateDraining(op *ops.Operation) {
+	instances, err := op.Instances()
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't get list of instances in ECS cluster %s: %v\n"), op.Cluster.Name, err)
+		return
+	}
+
+	draining := []aws.EcsInstance{}
+	for _, inst := range instances {
+		if inst.Status == "DRAINING" {
+			draining = append(draining, inst)
+		}
+	}
+
+	if len(draining) == 0 {
+		fmt.Println(p.Info("\U00002714 No DRAINING instances in cluster."))
+		return
+	}
+
+	selected, err := selectInstances(draining)
+
+	if err != nil {
+		return
+	}
+
+	if !allowAction(op, ops.ActionActivate) {
+		return
+	}
+
+	if !confirm(fmt.Sprintf("Reactivate %d instance(s)", len(selected)), false) {
+		return
+	}
+
+	reactivate(op, selected)
+}
+
+// reactivate - activate instances and print results
+func reactivate(op *ops.Operation, instances []aws.EcsInstance) {
+	results, err := op.RunOnInstances(context.Background(), ops.ActionActivate, instances)
+
+	if err != nil {
+		fmt.Printf(p.Error("\U00002717 %v\n"), err)
+	}
+
+	if len(results) > 0 {
+		printBulkResults(results)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/notify"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+
+	"github.com/briandowns/spinner"
+	"github.com/manifoldco/promptui"
+)
+
+// terminalReporter prints operation events to terminal
+type terminalReporter struct {
+	// Held while event is printed, or while operator is asked what to do
+	mu       sync.Mutex
+	spinner  *spinner.Spinner
+	waiting  bool
+	progress bool
+	// Progress of rotation, printed when rotation starts and when instance is replaced
+	rotation *rotationProgress
+}
+
+// newTerminalReporter - create new terminal reporter
+func newTerminalReporter() *terminalReporter {
+	return &terminalReporter{
+		spinner: spinner.New(spinner.CharSets[11], 200*time.Millisecond),
+	}
+}
+
+// Report - print event
+func (r *terminalReporter) Report(e ops.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rotation != nil {
+		r.rotation.Report(e)
+	}
+
+	// Don't let spinner overwrite messages printed while waiting
+	r.spinner.Stop()
+
+	// Progress line is overwritten by the next progress event only
+	if r.progress && e.Type != ops.EventProgress {
+		fmt.Println()
+		r.progress = false
+	}
+
+	switch e.Type {
+	case ops.EventInstance:
+		fmt.Printf(p.Info("\U0001F5A5  [%02d/%02d] Instance %s (%s)\n"), e.Index, e.Total, e.Instance, e.Ec2InstanceID)
+	case ops.EventAction:
+		fmt.Printf(p.Info("   \U0000276F %s: "), e.Message)
+		if e.Error != "" {
+			fmt.Printf(p.Error("FAILED\n      \U00002937 \U00002717 %s\n"), e.Error)
+		} else if e.Result == "EXCLUDED" {
+			fmt.Println(p.Green(e.Result))
+		} else {
+			fmt.Println(p.Yellow(e.Result))
+		}
+	case ops.EventProgress:
+		fmt.Printf("\r   \U0000276F %s %s  ", p.Grey(e.Message), p.Green(e.Result))
+		r.progress = true
+	case ops.EventWait:
+		r.spinner.Prefix = fmt.Sprintf("   \U0000276F %s ", p.Grey(e.Message))
+		r.waiting = true
+	case ops.EventWaitDone:
+		r.waiting = false
+		fmt.Printf("   \U0000276F %s \n", p.Grey(e.Message))
+	case ops.EventReplaced:
+		fmt.Printf(p.Info("   \U00002714 [%02d/%02d] Instance %s (%s) replaced\n"), e.Index, e.Total, e.Instance, e.Ec2InstanceID)
+		if r.rotation != nil {
+			fmt.Printf("   %s\n", p.Grey(r.rotation.String()))
+		}
+	case ops.EventStart:
+		if r.rotation != nil {
+			fmt.Printf("   %s\n", p.Grey(r.rotation.String()))
+		}
+	case ops.EventTimeout:
+		fmt.Printf(p.Error("   \U00002717 %s\n"), e.Error)
+	case ops.EventInfo:
+		fmt.Printf("   \U0000276F %s\n", p.Grey(e.Message))
+	case ops.EventWarning:
+		fmt.Printf(p.Warn("   \U000026A0 %s\n"), e.Message)
+	case ops.EventError:
+		fmt.Printf(p.Error("   \U00002717 %s\n"), e.Message)
+	}
+
+	if r.waiting {
+		r.spinner.Start()
+	}
+}
+
+// stop - stop spinner, if running
+func (r *terminalReporter) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.waiting = false
+	r.spinner.Stop()
+	if r.progress {
+		fmt.Println()
+		r.progress = false
+	}
+}
+
+// askInterrupt - stop spinner and ask what to do with interrupted operation.
+// Events are not printed, and operation waits for the next one to be printed,
+// until operator answers.
+func (r *terminalReporter) askInterrupt() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spinner.Stop()
+	if r.progress {
+		fmt.Println()
+		r.progress = false
+	}
+
+	fmt.Println(p.Warn("\n   \U000026A0 Interrupted"))
+
+	prompt := promptui.Select{
+		Label: "[ What do you want to do ]",
+		Items: []string{
+			"Continue",
+			"Finish current instance, then stop",
+			"Stop now and reactivate drained instances",
+			"Abort, leave instances as they are",
+		},
+	}
+
+	i, _, err := prompt.Run()
+
+	if err != nil {
+		return interruptAbort
+	}
+
+	choice := []string{interruptContinue, interruptFinish, interruptStop, interruptAbort}[i]
+
+	if r.waiting && (choice == interruptContinue || choice == interruptFinish) {
+		r.spinner.Start()
+	}
+
+	return choice
+}
+
+// withNotifications - send events to terminal reporter and to notification
+// targets of cluster, failed notifications are printed as warnings
+func withNotifications(clust aws.EcsCluster, r *terminalReporter) ops.Reporter {
+	n := notify.New(clust.Name, cfg.Cluster(clust.ARN).Notifications)
+	n.OnError = func(err error) {
+		r.Report(ops.Event{Type: ops.EventWarning, Message: err.Error()})
+	}
+
+	return ops.Reporters(r, n)
+}
+
+// pause - ask whether to retry failed hook, ignore it or abort operation
+func (r *terminalReporter) pause(message string) string {
+	r.stop()
+
+	fmt.Println(p.Warn("   \U000026A0 Paused, hook failed"))
+
+	prompt := promptui.Select{
+		Label: "[ What do you want to do ]",
+		Items: []string{"Retry hook", "Ignore failed hook and continue", "Abort"},
+	}
+
+	i, _, err := prompt.Run()
+
+	if err != nil {
+		return ops.DecisionAbort
+	}
+
+	return []string{ops.DecisionRetry, ops.DecisionContinue, ops.DecisionAbort}[i]
+}
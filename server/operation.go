@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/ops"
+)
+
+// Operation statuses
+const (
+	// StatusRunning - operation is running
+	StatusRunning = "running"
+	// StatusSucceeded - operation finished successfully
+	StatusSucceeded = "succeeded"
+	// StatusFailed - operation, or some of its actions, failed
+	StatusFailed = "failed"
+	// StatusCancelled - operation was cancelled
+	StatusCancelled = "cancelled"
+)
+
+// Result holds result of action on instance
+type Result struct {
+	Instance      string `json:"instance"`
+	Ec2InstanceID string `json:"ec2_instance_id"`
+	Result        string `json:"result"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Info holds state of long-running operation started through API
+type Info struct {
+	ID         string     `json:"id"`
+	Cluster    string     `json:"cluster"`
+	Action     string     `json:"action"`
+	Instances  []string   `json:"instances,omitempty"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Results    []Result   `json:"results,omitempty"`
+	Events     int        `json:"events"`
+}
+
+// Operation runs in background and collects its events
+type Operation struct {
+	mu     sync.Mutex
+	info   Info
+	events []ops.Event
+	notify chan struct{}
+	cancel context.CancelFunc
+}
+
+// newOperation - create new running operation
+func newOperation(cluster string, action string, instances []string, cancel context.CancelFunc) *Operation {
+	return &Operation{
+		info: Info{
+			ID:        ops.NewID(),
+			Cluster:   cluster,
+			Action:    action,
+			Instances: instances,
+			Status:    StatusRunning,
+			StartedAt: time.Now(),
+		},
+		notify: make(chan struct{}),
+		cancel: cancel,
+	}
+}
+
+// Report - store event and wake up clients streaming events
+func (o *Operation) Report(e ops.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, e)
+	o.info.Events = len(o.events)
+	o.wake()
+}
+
+// finish - set final status of operation
+func (o *Operation) finish(results []ops.Result, err error, cancelled bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	o.info.FinishedAt = &now
+
+	for _, r := range results {
+		res := Result{Instance: r.Instance.Name, Ec2InstanceID: r.Instance.Ec2InstanceID, Result: r.Result}
+		if r.Error != nil {
+			res.Error = r.Error.Error()
+			if err == nil {
+				err = errFailedActions
+			}
+		}
+		o.info.Results = append(o.info.Results, res)
+	}
+
+	switch {
+	case cancelled:
+		o.info.Status = StatusCancelled
+	case err != nil && err != ops.ErrNoInstances:
+		o.info.Status = StatusFailed
+		o.info.Error = err.Error()
+	default:
+		o.info.Status = StatusSucceeded
+	}
+
+	o.wake()
+}
+
+// wake - wake up clients waiting for changes, must be called with lock held
+func (o *Operation) wake() {
+	close(o.notify)
+	o.notify = make(chan struct{})
+}
+
+// Cancel - cancel running operation
+func (o *Operation) Cancel() {
+	o.cancel()
+}
+
+// Info - get current state of operation
+func (o *Operation) Info() Info {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	info := o.info
+	info.Results = append([]Result{}, o.info.Results...)
+
+	return info
+}
+
+// eventsSince - get events after first n ones, channel which is closed on the
+// next change and whether operation is finished
+func (o *Operation) eventsSince(n int) ([]ops.Event, <-chan struct{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	events := []ops.Event{}
+	if n < len(o.events) {
+		events = append(events, o.events[n:]...)
+	}
+
+	return events, o.notify, o.info.Status != StatusRunning
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/aws"
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/lease"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+)
+
+// Returned as error of operation when action failed on some of instances
+var errFailedActions = errors.New("Action failed on some of instances")
+
+// Returned as error of operation when cluster lock is taken over, or expires, while it runs
+var errLockLost = errors.New("Cluster lock was lost, operation stopped")
+
+// Finished operations kept by default, older ones are forgotten
+const (
+	// DefaultRetention - how long finished operation is kept
+	DefaultRetention = 24 * time.Hour
+	// DefaultMaxFinished - how many finished operations are kept
+	DefaultMaxFinished = 100
+)
+
+// request holds body of request starting operation
+type request struct {
+	Cluster   string   `json:"cluster"`
+	Action    string   `json:"action"`
+	Instances []string `json:"instances"`
+	// Cluster name, required for destructive actions on protected clusters
+	ConfirmCluster string `json:"confirm_cluster"`
+	// Reason for running action outside of change windows
+	OverrideReason string `json:"override_reason"`
+}
+
+// Server serves HTTP API for listing clusters and instances and running
+// long-running operations in background
+type Server struct {
+	// If set, requests must have "Authorization: Bearer <token>" header
+	Token string
+	// Get cluster specific settings
+	Options func(clust aws.EcsCluster) ops.Options
+	// Get container instance IDs excluded from rotation
+	Excluded func(clust aws.EcsCluster, instances []aws.EcsInstance) ([]string, error)
+	// Get reporter notifying about operation progress, e.g. webhooks
+	Notify func(clust aws.EcsCluster) ops.Reporter
+	// Called when operation is started or finished
+	Log func(format string, a ...interface{})
+	// How long finished operations are kept
+	Retention time.Duration
+	// How many finished operations are kept
+	MaxFinished int
+
+	mu         sync.Mutex
+	operations map[string]*Operation
+	order      []string
+}
+
+// New - create new server
+func New(token string) *Server {
+	return &Server{
+		Token: token,
+		Options: func(aws.EcsCluster) ops.Options {
+			return ops.Options{}
+		},
+		Excluded: func(aws.EcsCluster, []aws.EcsInstance) ([]string, error) {
+			return []string{}, nil
+		},
+		Notify: func(aws.EcsCluster) ops.Reporter {
+			return ops.ReporterFunc(func(ops.Event) {})
+		},
+		Log:         func(string, ...interface{}) {},
+		Retention:   DefaultRetention,
+		MaxFinished: DefaultMaxFinished,
+		operations:  map[string]*Operation{},
+	}
+}
+
+// ServeHTTP - authenticate and route request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "clusters":
+		s.allow(w, r, http.MethodGet, s.listClusters)
+	case len(parts) == 3 && parts[0] == "clusters" && parts[2] == "instances":
+		s.allow(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			s.listInstances(w, r, parts[1])
+		})
+	case len(parts) == 1 && parts[0] == "operations":
+		switch r.Method {
+		case http.MethodGet:
+			s.listOperations(w, r)
+		case http.MethodPost:
+			s.startOperation(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 2 && parts[0] == "operations":
+		switch r.Method {
+		case http.MethodGet:
+			s.getOperation(w, r, parts[1])
+		case http.MethodDelete:
+			s.cancelOperation(w, r, parts[1])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 3 && parts[0] == "operations" && parts[2] == "events":
+		s.allow(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			s.streamEvents(w, r, parts[1])
+		})
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// allow - call handler only if request method matches
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, method string, h http.HandlerFunc) {
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	h(w, r)
+}
+
+// listClusters - GET /clusters
+func (s *Server) listClusters(w http.ResponseWriter, r *http.Request) {
+	clusters, err := aws.GetEcsClusters()
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Couldn't get list of ECS clusters: %v", err))
+		return
+	}
+
+	clustersInfo := []aws.EcsCluster{}
+
+	if len(clusters) > 0 {
+		clustersInfo, err = aws.GetEcsClustersInfo(clusters)
+
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Couldn't get list of ECS clusters: %v", err))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, clustersInfo)
+}
+
+// listInstances - GET /clusters/<cluster>/instances
+func (s *Server) listInstances(w http.ResponseWriter, r *http.Request, nameOrArn string) {
+	clust, status, err := findCluster(nameOrArn)
+
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	instances, err := ops.New(clust, ops.Options{}, nil).Instances()
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Couldn't get list of instances in ECS cluster %s: %v", clust.Name, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instances)
+}
+
+// listOperations - GET /operations
+func (s *Server) listOperations(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.prune(time.Now())
+	list := []Info{}
+	for _, id := range s.order {
+		list = append(list, s.operations[id].Info())
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getOperation - GET /operations/<id>
+func (s *Server) getOperation(w http.ResponseWriter, r *http.Request, id string) {
+	o, ok := s.operation(id)
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Operation %s not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, o.Info())
+}
+
+// cancelOperation - DELETE /operations/<id>
+func (s *Server) cancelOperation(w http.ResponseWriter, r *http.Request, id string) {
+	o, ok := s.operation(id)
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Operation %s not found", id))
+		return
+	}
+
+	o.Cancel()
+	s.Log("Operation %s cancelled", id)
+
+	writeJSON(w, http.StatusAccepted, o.Info())
+}
+
+// streamEvents - GET /operations/<id>/events, events are written as JSON
+// objects, one per line. Unless follow=false is given, new events are
+// streamed until operation is finished.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, id string) {
+	o, ok := s.operation(id)
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Operation %s not found", id))
+		return
+	}
+
+	follow := r.URL.Query().Get("follow") != "false"
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	sent := 0
+
+	for {
+		events, changed, finished := o.eventsSince(sent)
+
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if finished || !follow {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// startOperation - POST /operations
+func (s *Server) startOperation(w http.ResponseWriter, r *http.Request) {
+	var req request
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	clusterAction := common.ElementInSlice(req.Action, ops.ClusterActions)
+
+	switch {
+	case req.Cluster == "":
+		writeError(w, http.StatusBadRequest, "Cluster not specified")
+		return
+	case !clusterAction && !common.ElementInSlice(req.Action, ops.Actions):
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown action %q, use one of: %s", req.Action, strings.Join(append(append([]string{}, ops.Actions...), ops.ClusterActions...), ", ")))
+		return
+	case clusterAction && len(req.Instances) > 0:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Action %s runs on all instances in cluster, instances can't be specified", req.Action))
+		return
+	case !clusterAction && len(req.Instances) == 0:
+		writeError(w, http.StatusBadRequest, "Instances not specified")
+		return
+	}
+
+	clust, status, err := findCluster(req.Cluster)
+
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	opts := s.Options(clust)
+	opts.OverrideReason = req.OverrideReason
+
+	if err := ops.New(clust, opts, nil).Allowed(req.Action); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	if opts.Protected && ops.IsDestructive(req.Action) && req.ConfirmCluster != clust.Name {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Cluster %s is protected, set confirm_cluster to cluster name to run %s", clust.Name, req.Action))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o := newOperation(clust.Name, req.Action, req.Instances, cancel)
+	op := ops.New(clust, opts, ops.Reporters(o, s.Notify(clust)))
+	op.ID = o.info.ID
+
+	instances := []aws.EcsInstance{}
+
+	if clusterAction {
+		if req.Action == ops.ActionRotate {
+			all, err := op.Instances()
+
+			if err == nil {
+				op.Options.Excluded, err = s.Excluded(clust, all)
+			}
+
+			if err != nil {
+				cancel()
+				writeError(w, http.StatusBadGateway, fmt.Sprintf("Couldn't get list of excluded instances: %v", err))
+				return
+			}
+		}
+	} else {
+		instances, err = op.FindInstances(req.Instances)
+
+		if err != nil {
+			cancel()
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Refuse to run operation if somebody else is working on cluster
+	var l *lease.Lease
+	var lost atomic.Bool
+
+	if lease.Required(req.Action) {
+		l, err = lease.Acquire(clust.ARN, req.Action, lease.DefaultTTL, false)
+
+		if err != nil {
+			cancel()
+
+			if _, ok := err.(lease.HeldError); ok {
+				writeError(w, http.StatusConflict, err.Error())
+			} else {
+				writeError(w, http.StatusBadGateway, err.Error())
+			}
+			return
+		}
+
+		// Operation is stopped if lock is taken over, or expires, while it runs
+		go l.KeepAlive(ctx, func() {
+			lost.Store(true)
+			cancel()
+		}, func(err error) {
+			s.Log("Operation %s: couldn't renew cluster lock: %v", o.info.ID, err)
+		})
+	}
+
+	s.mu.Lock()
+	s.prune(time.Now())
+	s.operations[o.info.ID] = o
+	s.order = append(s.order, o.info.ID)
+	s.mu.Unlock()
+
+	s.Log("Operation %s started: %s on cluster %s", o.info.ID, req.Action, clust.Name)
+
+	go func() {
+		defer cancel()
+
+		var results []ops.Result
+		var err error
+
+		switch req.Action {
+		case ops.ActionUpdateAgents:
+			err = op.UpdateAgents(ctx)
+		case ops.ActionRotate:
+			err = op.Rotate(ctx)
+		default:
+			results, err = op.RunOnInstances(ctx, req.Action, instances)
+		}
+
+		if lost.Load() {
+			o.finish(results, errLockLost, false)
+		} else {
+			o.finish(results, err, ctx.Err() != nil)
+		}
+
+		if l != nil && !lost.Load() {
+			if err := l.Release(); err != nil {
+				s.Log("Operation %s: couldn't release cluster lock: %v", o.info.ID, err)
+			}
+		}
+
+		info := o.Info()
+		s.Log("Operation %s finished: %s %s", info.ID, info.Status, info.Error)
+	}()
+
+	writeJSON(w, http.StatusAccepted, o.Info())
+}
+
+// operation - find operation by ID
+func (s *Server) operation(id string) (*Operation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.operations[id]
+	return o, ok
+}
+
+// prune - forget finished operations which are older than retention period,
+// or over the limit of finished operations, the oldest ones first. Running
+// operations are always kept. Server must be locked.
+func (s *Server) prune(now time.Time) {
+	keep := map[string]bool{}
+	finished := 0
+
+	for i := len(s.order) - 1; i >= 0; i-- {
+		id := s.order[i]
+		info := s.operations[id].Info()
+
+		if info.FinishedAt != nil {
+			finished++
+
+			if finished > s.MaxFinished || now.Sub(*info.FinishedAt) > s.Retention {
+				delete(s.operations, id)
+				continue
+			}
+		}
+
+		keep[id] = true
+	}
+
+	order := []string{}
+	for _, id := range s.order {
+		if keep[id] {
+			order = append(order, id)
+		}
+	}
+	s.order = order
+}
+
+// findCluster - find cluster by name or ARN, returns HTTP status to use on error
+func findCluster(nameOrArn string) (aws.EcsCluster, int, error) {
+	clustersInfo, err := aws.GetEcsClustersInfo([]string{nameOrArn})
+
+	if err != nil {
+		return aws.EcsCluster{}, http.StatusBadGateway, fmt.Errorf("Couldn't get cluster %s: %v", nameOrArn, err)
+	}
+
+	if len(clustersInfo) == 0 {
+		return aws.EcsCluster{}, http.StatusNotFound, fmt.Errorf("Cluster %s not found", nameOrArn)
+	}
+
+	return clustersInfo[0], http.StatusOK, nil
+}
+
+// writeJSON - write value as JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError - write error as JSON response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
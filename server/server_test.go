@@ -0,0 +1,88 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+
+	// Operations in order they were started, finished given time ago, or running if negative
+	tests := []struct {
+		name        string
+		finished    []time.Duration
+		retention   time.Duration
+		maxFinished int
+		want        string
+	}{
+		{
+			name:        "nothing to prune",
+			finished:    []time.Duration{time.Hour, -1, time.Minute},
+			retention:   DefaultRetention,
+			maxFinished: DefaultMaxFinished,
+			want:        "0,1,2",
+		},
+		{
+			name:        "older than retention",
+			finished:    []time.Duration{48 * time.Hour, 25 * time.Hour, -1, 23 * time.Hour},
+			retention:   DefaultRetention,
+			maxFinished: DefaultMaxFinished,
+			want:        "2,3",
+		},
+		{
+			name:        "over limit, oldest first",
+			finished:    []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute},
+			retention:   DefaultRetention,
+			maxFinished: 2,
+			want:        "2,3",
+		},
+		{
+			name:        "running operations are kept",
+			finished:    []time.Duration{-1, 48 * time.Hour, -1, time.Minute, time.Minute},
+			retention:   DefaultRetention,
+			maxFinished: 1,
+			want:        "0,2,4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("")
+			s.Retention = tt.retention
+			s.MaxFinished = tt.maxFinished
+
+			names := map[string]string{}
+
+			for i, ago := range tt.finished {
+				o := newOperation("test", "drain", nil, func() {})
+
+				if ago >= 0 {
+					finishedAt := now.Add(-ago)
+					o.info.FinishedAt = &finishedAt
+					o.info.Status = StatusSucceeded
+				}
+
+				s.operations[o.info.ID] = o
+				s.order = append(s.order, o.info.ID)
+				names[o.info.ID] = string(rune('0' + i))
+			}
+
+			s.prune(now)
+
+			got := []string{}
+			for _, id := range s.order {
+				got = append(got, names[id])
+			}
+
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("kept operations %s, want %s", strings.Join(got, ","), tt.want)
+			}
+
+			if len(s.operations) != len(s.order) {
+				t.Errorf("%d operations for %d IDs", len(s.operations), len(s.order))
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+	"gitlab.com/mzdrale/ecs-manager/ops"
+	"gitlab.com/mzdrale/ecs-manager/output"
+
+	p "gitlab.com/mzdrale/ecs-manager/prompt"
+)
+
+// Results of instances in rotation summary
+const (
+	summaryInProgress = "in progress"
+	summaryDrained    = "drained"
+	summaryTerminated = "terminated"
+	summaryReplaced   = "replaced"
+	summaryExcluded   = "excluded"
+	summaryFailed     = "failed"
+)
+
+// Formats of rotation report file
+var reportFormats = []exportFormat{
+	{"Markdown", output.Markdown, "md"},
+	{"HTML", output.HTML, "html"},
+}
+
+// summaryInstance holds what rotation did with instance
+type summaryInstance struct {
+	Instance         string   `json:"instance"`
+	Result           string   `json:"result"`
+	Ec2InstanceID    string   `json:"old_ec2_instance_id"`
+	NewEc2InstanceID string   `json:"new_ec2_instance_id"`
+	AMI              string   `json:"old_ami"`
+	NewAMI           string   `json:"new_ami"`
+	Drain            string   `json:"drain"`
+	Terminate        string   `json:"terminate"`
+	Replace          string   `json:"replacement"`
+	ForceStopped     int      `json:"force_stopped"`
+	StoppedTasks     []string `json:"stopped_tasks"`
+	Errors           []string `json:"errors"`
+}
+
+// Columns of summary table printed to terminal, stopped tasks and errors are
+// listed below it
+var summaryColumns = []string{"instance", "result", "old_ec2_instance_id", "new_ec2_instance_id", "old_ami", "new_ami", "drain", "terminate", "replacement", "force_stopped"}
+
+// rotationSummary collects results of instances from rotation events
+type rotationSummary struct {
+	mu        sync.Mutex
+	cluster   string
+	started   time.Time
+	finished  time.Time
+	err       error
+	total     int
+	instances []*summaryInstance
+}
+
+// Report - collect result of instance from event
+func (s *rotationSummary) Report(e ops.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e.Type {
+	case ops.EventStart:
+		s.total = e.Total
+	case ops.EventInstance:
+		s.instances = append(s.instances, &summaryInstance{
+			Instance:      e.Instance,
+			Ec2InstanceID: e.Ec2InstanceID,
+			AMI:           e.AMI,
+			Result:        summaryInProgress,
+			StoppedTasks:  []string{},
+			Errors:        []string{},
+		})
+	}
+
+	inst := s.current(e.Instance)
+	if inst == nil {
+		return
+	}
+
+	switch e.Type {
+	case ops.EventAction:
+		if e.Error != "" {
+			inst.Errors = append(inst.Errors, fmt.Sprintf("%s: %s", e.Message, e.Error))
+
+			if e.Action == ops.ActionDrain || e.Action == ops.ActionTerminate {
+				inst.Result = summaryFailed
+			}
+			return
+		}
+
+		switch {
+		case e.Result == "EXCLUDED":
+			inst.Result = summaryExcluded
+		case e.Action == ops.ActionDrain:
+			inst.Result = summaryDrained
+		case e.Action == ops.ActionTerminate:
+			inst.Result = summaryTerminated
+		case e.Action == ops.ActionStopTask:
+			inst.ForceStopped++
+			inst.StoppedTasks = append(inst.StoppedTasks, strings.TrimPrefix(e.Message, "Stop "))
+		}
+	case ops.EventError, ops.EventTimeout:
+		inst.Errors = append(inst.Errors, e.Message)
+	case ops.EventReplaced:
+		inst.Result = summaryReplaced
+
+		if r := e.Replacement; r != nil {
+			inst.NewEc2InstanceID = r.NewEc2InstanceID
+			inst.NewAMI = r.NewAMI
+			inst.Drain = formatWait(r.Drain)
+			inst.Terminate = formatWait(r.Terminate)
+			inst.Replace = formatWait(r.Replace)
+		}
+	}
+}
+
+// current - get instance rotation is working on, if event is about it
+func (s *rotationSummary) current(name string) *summaryInstance {
+	if name == "" || len(s.instances) == 0 {
+		return nil
+	}
+
+	inst := s.instances[len(s.instances)-1]
+	if inst.Instance != name {
+		return nil
+	}
+
+	return inst
+}
+
+// rows - get copy of collected instances
+func (s *rotationSummary) rows() []summaryInstance {
+	rows := []summaryInstance{}
+	for _, inst := range s.instances {
+		rows = append(rows, *inst)
+	}
+	return rows
+}
+
+// pending - get number of instances rotation didn't reach
+func (s *rotationSummary) pending() int {
+	if n := s.total - len(s.instances); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// print - print table with result of each instance, followed by stopped
+// tasks and errors, and number of instances which weren't reached
+func (s *rotationSummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Println(p.Info("\n\U0001F5A5 Summary"))
+
+	if len(s.instances) == 0 {
+		fmt.Println("   No instances were touched")
+		return
+	}
+
+	fmt.Println()
+	output.Write(os.Stdout, output.Table, s.rows(), summaryColumns...)
+	fmt.Println()
+
+	for _, inst := range s.instances {
+		if len(inst.StoppedTasks) == 0 && len(inst.Errors) == 0 {
+			continue
+		}
+
+		fmt.Printf("   \U0000276F %s (%s)\n", inst.Instance, inst.Ec2InstanceID)
+
+		for _, task := range inst.StoppedTasks {
+			fmt.Printf("      \U00002937 Force stopped %s\n", task)
+		}
+
+		for _, err := range inst.Errors {
+			fmt.Printf("      \U00002937 %s\n", p.Error(err))
+		}
+	}
+
+	if pending := s.pending(); pending > 0 {
+		fmt.Printf(p.Warn("   \U000026A0 %d instance(s) not reached\n"), pending)
+	}
+}
+
+// write - write report with summary to file, in Markdown or HTML
+func (s *rotationSummary) write(path string, format string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if format == output.HTML {
+		err = s.writeHTML(f)
+	} else {
+		err = s.writeMarkdown(f)
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// details - get name and value of report details, e.g. cluster and duration
+func (s *rotationSummary) details() [][2]string {
+	result := "Finished successfully"
+	if s.err != nil {
+		result = s.err.Error()
+	}
+
+	details := [][2]string{
+		{"Cluster", s.cluster},
+		{"Run by", fmt.Sprintf("%s@%s", common.CurrentUser(), common.Hostname())},
+		{"Started", s.started.Format(time.RFC1123)},
+		{"Finished", s.finished.Format(time.RFC1123)},
+		{"Duration", common.FormatDuration(s.finished.Sub(s.started))},
+		{"Result", result},
+	}
+
+	if pending := s.pending(); pending > 0 {
+		details = append(details, [2]string{"Not reached", fmt.Sprintf("%d instance(s)", pending)})
+	}
+
+	return details
+}
+
+// writeMarkdown - write report in Markdown
+func (s *rotationSummary) writeMarkdown(w io.Writer) error {
+	fmt.Fprintf(w, "# Rotation of cluster %s\n\n", s.cluster)
+
+	for _, d := range s.details() {
+		fmt.Fprintf(w, "- **%s:** %s\n", d[0], d[1])
+	}
+
+	fmt.Fprintln(w)
+
+	return output.Write(w, output.Markdown, s.rows())
+}
+
+// writeHTML - write report in HTML
+func (s *rotationSummary) writeHTML(w io.Writer) error {
+	title := html.EscapeString(fmt.Sprintf("Rotation of cluster %s", s.cluster))
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", title)
+	fmt.Fprintf(w, "<h1>%s</h1>\n<ul>\n", title)
+
+	for _, d := range s.details() {
+		fmt.Fprintf(w, "  <li><b>%s:</b> %s</li>\n", html.EscapeString(d[0]), html.EscapeString(d[1]))
+	}
+
+	fmt.Fprintln(w, "</ul>")
+
+	if err := output.Write(w, output.HTML, s.rows()); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(w, "</body>\n</html>")
+	return err
+}
+
+// reportFormat - get format of report file from its extension, Markdown is default
+func reportFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return output.HTML
+	}
+	return output.Markdown
+}
+
+// formatWait - format time spent waiting, rounded to seconds
+func formatWait(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// rotateCluster - rotate cluster while trapping Ctrl-C and SIGTERM. Operator
+// can finish current instance and stop, stop now and reactivate drained
+// instances, or abort, see handleInterrupts. Summary is printed at the end,
+// and reactivation of drained instances is offered if rotation failed.
+// Returns summary, choice made on interrupt and error of rotation.
+func rotateCluster(op *ops.Operation, reporter *terminalReporter, takeOver bool) (*rotationSummary, string, error) {
+	summary := &rotationSummary{cluster: op.Cluster.Name}
+
+	reporters := op.Reporter
+	op.Reporter = ops.Reporters(reporters, summary)
+	defer func() { op.Reporter = reporters }()
+
+	progress := newRotationProgress(op.Cluster)
+	reporter.rotation = progress
+	defer func() { reporter.rotation = nil }()
+
+	ctx, interrupted, stopInterrupts := handleInterrupts(context.Background(), op, reporter)
+
+	startTime := time.Now()
+	err := runWithLease(ctx, op.Cluster, ops.ActionRotate, takeOver, func(ctx context.Context) error {
+		err := op.Rotate(ctx)
+		reporter.stop()
+		return err
+	})
+	stopInterrupts()
+
+	if err := progress.record(op.Cluster); err != nil {
+		fmt.Printf(p.Warn("\U000026A0 Couldn't record rotation in history: %v\n"), err)
+	}
+
+	summary.mu.Lock()
+	summary.started = startTime
+	summary.finished = time.Now()
+	summary.err = err
+	summary.mu.Unlock()
+
+	choice := interrupted.get()
+
+	switch {
+	case choice == interruptStop && (err == context.Canceled || err == nil):
+		fmt.Println(p.Warn("\U000026A0 Rotation stopped"))
+	case choice == interruptAbort && (err == context.Canceled || err == nil):
+		fmt.Println(p.Warn("\U000026A0 Rotation aborted, instances are left as they are"))
+	default:
+		printOperationError(err)
+	}
+
+	if err != ops.ErrNoInstances {
+		summary.print()
+	}
+
+	switch {
+	case choice == interruptStop:
+		if drained := op.Drained(startTime); len(drained) > 0 {
+			reactivate(op, drained)
+		}
+	case choice == interruptAbort:
+	case err != nil && err != ops.ErrNoInstances:
+		offerReactivation(op, startTime)
+	}
+
+	printDuration(startTime)
+
+	return summary, choice, err
+}
+
+// saveRotationReport - write rotation report to file and report where it is
+func saveRotationReport(summary *rotationSummary, path string, format string) error {
+	if err := summary.write(path, format); err != nil {
+		fmt.Printf(p.Error("\U00002717 Couldn't write rotation report: %v\n"), err)
+		return err
+	}
+
+	fmt.Printf(p.Info("\U00002714 Rotation report written to %s\n"), path)
+	return nil
+}
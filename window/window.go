@@ -0,0 +1,277 @@
+package window
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/mzdrale/ecs-manager/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Window holds weekly change window, e.g. Monday to Thursday from 09:00 to
+// 16:00 in Europe/Belgrade. Window ending before it starts spans midnight.
+type Window struct {
+	// Days of week, all days if empty
+	Days []string `yaml:"days"`
+	// Start time, HH:MM
+	From string `yaml:"from"`
+	// End time, HH:MM, not included in window
+	To string `yaml:"to"`
+	// Time zone, UTC if empty
+	Timezone string `yaml:"timezone"`
+}
+
+// Freeze holds change freeze, dates when changes are not allowed
+type Freeze struct {
+	// First day of freeze, YYYY-MM-DD
+	From string `yaml:"from"`
+	// Last day of freeze, YYYY-MM-DD, the same as first day if empty
+	To string `yaml:"to"`
+	// Time zone, UTC if empty
+	Timezone string `yaml:"timezone"`
+	// Why changes are not allowed
+	Reason string `yaml:"reason"`
+}
+
+// ClosedError - returned when changes are not allowed at given time
+type ClosedError struct {
+	Message string
+}
+
+// Error - format closed error
+func (e ClosedError) Error() string {
+	return e.Message
+}
+
+// Day names, as accepted in config, by weekday
+var days = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Date format of freeze dates
+const dateFormat = "2006-01-02"
+
+// UnmarshalYAML - decode window, rejecting unknown keys and invalid values
+func (w *Window) UnmarshalYAML(node *yaml.Node) error {
+	if err := checkKeys(node, "change window", []string{"days", "from", "to", "timezone"}); err != nil {
+		return err
+	}
+
+	type plain Window
+	if err := node.Decode((*plain)(w)); err != nil {
+		return err
+	}
+
+	return w.Validate()
+}
+
+// UnmarshalYAML - decode freeze, rejecting unknown keys and invalid values
+func (f *Freeze) UnmarshalYAML(node *yaml.Node) error {
+	if err := checkKeys(node, "freeze", []string{"from", "to", "timezone", "reason"}); err != nil {
+		return err
+	}
+
+	type plain Freeze
+	if err := node.Decode((*plain)(f)); err != nil {
+		return err
+	}
+
+	return f.Validate()
+}
+
+// Validate - check days, times and time zone of window
+func (w Window) Validate() error {
+	for _, d := range w.Days {
+		if _, ok := days[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %q in change window, use mon, tue, wed, thu, fri, sat or sun", d)
+		}
+	}
+
+	if _, err := parseClock(w.From); err != nil {
+		return fmt.Errorf("invalid from %q in change window, use HH:MM", w.From)
+	}
+
+	if _, err := parseClock(w.To); err != nil {
+		return fmt.Errorf("invalid to %q in change window, use HH:MM", w.To)
+	}
+
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q in change window", w.Timezone)
+	}
+
+	return nil
+}
+
+// Validate - check dates and time zone of freeze
+func (f Freeze) Validate() error {
+	if _, err := time.Parse(dateFormat, f.From); err != nil {
+		return fmt.Errorf("invalid from %q in freeze, use YYYY-MM-DD", f.From)
+	}
+
+	if f.To != "" {
+		to, err := time.Parse(dateFormat, f.To)
+		if err != nil {
+			return fmt.Errorf("invalid to %q in freeze, use YYYY-MM-DD", f.To)
+		}
+
+		from, _ := time.Parse(dateFormat, f.From)
+		if to.Before(from) {
+			return fmt.Errorf("freeze ends on %s, before it starts on %s", f.To, f.From)
+		}
+	}
+
+	if _, err := time.LoadLocation(f.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q in freeze", f.Timezone)
+	}
+
+	return nil
+}
+
+// Contains - returns true if time is in window
+func (w Window) Contains(t time.Time) bool {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+
+	if from < to {
+		return w.hasDay(t.Weekday()) && minute >= from && minute < to
+	}
+
+	// Window spans midnight, it belongs to day it starts on
+	return (w.hasDay(t.Weekday()) && minute >= from) || (w.hasDay((t.Weekday()+6)%7) && minute < to)
+}
+
+// Contains - returns true if time is in freeze
+func (f Freeze) Contains(t time.Time) bool {
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		return false
+	}
+
+	last := f.To
+	if last == "" {
+		last = f.From
+	}
+
+	day := t.In(loc).Format(dateFormat)
+
+	return day >= f.From && day <= last
+}
+
+// String - describe window, e.g. "mon,tue 09:00-16:00 Europe/Belgrade"
+func (w Window) String() string {
+	d := "every day"
+	if len(w.Days) > 0 {
+		d = strings.ToLower(strings.Join(w.Days, ","))
+	}
+
+	tz := w.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	return fmt.Sprintf("%s %s-%s %s", d, w.From, w.To, tz)
+}
+
+// String - describe freeze, e.g. "2026-12-20 - 2027-01-05 (holidays)"
+func (f Freeze) String() string {
+	s := f.From
+	if f.To != "" && f.To != f.From {
+		s = fmt.Sprintf("%s - %s", f.From, f.To)
+	}
+
+	if f.Reason != "" {
+		s = fmt.Sprintf("%s (%s)", s, f.Reason)
+	}
+
+	return s
+}
+
+// Check - returns ClosedError if changes are not allowed at given time,
+// because of freeze or because time is outside of all windows. Without
+// windows changes are allowed at any time, except during freeze.
+func Check(windows []Window, freezes []Freeze, t time.Time) error {
+	for _, f := range freezes {
+		if f.Contains(t) {
+			return ClosedError{Message: fmt.Sprintf("Change freeze %s", f)}
+		}
+	}
+
+	if len(windows) == 0 {
+		return nil
+	}
+
+	allowed := []string{}
+
+	for _, w := range windows {
+		if w.Contains(t) {
+			return nil
+		}
+		allowed = append(allowed, w.String())
+	}
+
+	sort.Strings(allowed)
+
+	return ClosedError{Message: fmt.Sprintf("Outside of change windows: %s", strings.Join(allowed, "; "))}
+}
+
+// hasDay - returns true if window is open on given day of week
+func (w Window) hasDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, d := range w.Days {
+		if days[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseClock - parse HH:MM into minutes since midnight, 24:00 is allowed
+func parseClock(s string) (int, error) {
+	var h, m int
+
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	return h*60 + m, nil
+}
+
+// checkKeys - reject unknown keys in map node
+func checkKeys(node *yaml.Node, name string, keys []string) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s must be a map", name)
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		if !common.ElementInSlice(node.Content[i].Value, keys) {
+			return fmt.Errorf("unknown key %s in %s, use one of: %s", node.Content[i].Value, name, strings.Join(keys, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package window
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	workHours := Window{Days: []string{"mon", "tue", "wed", "thu"}, From: "09:00", To: "16:00", Timezone: "Europe/Belgrade"}
+	overnight := Window{Days: []string{"Friday"}, From: "22:00", To: "02:00"}
+	holidays := Freeze{From: "2026-12-24", To: "2027-01-02", Reason: "holidays"}
+	release := Freeze{From: "2026-10-21", Timezone: "Europe/Belgrade"}
+
+	// 2026-10-19 is Monday, Europe/Belgrade is UTC+2 until 2026-10-25
+	at := func(value string) time.Time {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name    string
+		windows []Window
+		freezes []Freeze
+		at      time.Time
+		closed  string
+	}{
+		{
+			name: "no windows and no freeze",
+			at:   at("2026-10-19T03:00:00Z"),
+		},
+		{
+			name:    "inside window",
+			windows: []Window{workHours},
+			at:      at("2026-10-19T07:00:00Z"),
+		},
+		{
+			name:    "window start is included",
+			windows: []Window{workHours},
+			at:      at("2026-10-19T09:00:00+02:00"),
+		},
+		{
+			name:    "window end is not included",
+			windows: []Window{workHours},
+			at:      at("2026-10-19T16:00:00+02:00"),
+			closed:  "Outside of change windows: mon,tue,wed,thu 09:00-16:00 Europe/Belgrade",
+		},
+		{
+			name:    "time in window time zone",
+			windows: []Window{workHours},
+			at:      at("2026-10-19T06:30:00Z"),
+			closed:  "Outside of change windows",
+		},
+		{
+			name:    "day outside window",
+			windows: []Window{workHours},
+			at:      at("2026-10-23T10:00:00+02:00"),
+			closed:  "Outside of change windows",
+		},
+		{
+			name:    "window spanning midnight, before midnight",
+			windows: []Window{overnight},
+			at:      at("2026-10-23T23:00:00Z"),
+		},
+		{
+			name:    "window spanning midnight, after midnight",
+			windows: []Window{overnight},
+			at:      at("2026-10-24T01:00:00Z"),
+		},
+		{
+			name:    "window spanning midnight, after midnight of other day",
+			windows: []Window{overnight},
+			at:      at("2026-10-23T01:00:00Z"),
+			closed:  "Outside of change windows",
+		},
+		{
+			name:    "any of windows",
+			windows: []Window{workHours, overnight},
+			at:      at("2026-10-23T23:30:00Z"),
+		},
+		{
+			name:    "windows are listed",
+			windows: []Window{workHours, overnight},
+			at:      at("2026-10-24T10:00:00Z"),
+			closed:  "Outside of change windows: friday 22:00-02:00 UTC; mon,tue,wed,thu 09:00-16:00 Europe/Belgrade",
+		},
+		{
+			name:    "freeze without windows",
+			freezes: []Freeze{holidays},
+			at:      at("2026-12-28T10:00:00Z"),
+			closed:  "Change freeze 2026-12-24 - 2027-01-02 (holidays)",
+		},
+		{
+			name:    "last day of freeze",
+			freezes: []Freeze{holidays},
+			at:      at("2027-01-02T23:59:00Z"),
+			closed:  "Change freeze",
+		},
+		{
+			name:    "after freeze",
+			freezes: []Freeze{holidays},
+			at:      at("2027-01-03T00:00:00Z"),
+		},
+		{
+			name:    "single day freeze in time zone",
+			freezes: []Freeze{release},
+			at:      at("2026-10-20T22:30:00Z"),
+			closed:  "Change freeze 2026-10-21",
+		},
+		{
+			name:    "freeze wins over window",
+			windows: []Window{workHours},
+			freezes: []Freeze{release},
+			at:      at("2026-10-21T10:00:00+02:00"),
+			closed:  "Change freeze",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.windows, tt.freezes, tt.at)
+
+			if tt.closed == "" {
+				if err != nil {
+					t.Errorf("Check = %v, want changes allowed", err)
+				}
+				return
+			}
+
+			var closed ClosedError
+			if !errors.As(err, &closed) {
+				t.Fatalf("Check = %v, want ClosedError", err)
+			}
+
+			if !strings.HasPrefix(closed.Message, tt.closed) {
+				t.Errorf("message = %q, want %q", closed.Message, tt.closed)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  Window
+		wantErr string
+	}{
+		{name: "valid", window: Window{Days: []string{"Mon", "friday"}, From: "09:00", To: "24:00", Timezone: "Europe/Belgrade"}},
+		{name: "invalid day", window: Window{Days: []string{"mo"}, From: "09:00", To: "16:00"}, wantErr: `invalid day "mo"`},
+		{name: "invalid from", window: Window{From: "9:00", To: "16:00"}, wantErr: `invalid from "9:00"`},
+		{name: "invalid to", window: Window{From: "09:00", To: "24:30"}, wantErr: `invalid to "24:30"`},
+		{name: "invalid timezone", window: Window{From: "09:00", To: "16:00", Timezone: "Mars/Olympus"}, wantErr: `invalid timezone "Mars/Olympus"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.window.Validate()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}